@@ -0,0 +1,335 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	zipMimeType   = "application/zip"
+	tarMimeType   = "application/x-tar"
+	tgzMimeType   = "application/x-compressed-tar"
+	gzipMimeType  = "application/gzip"
+	archiveMember = "!/"
+)
+
+// archiveMimeTypes are the archive formats whose members get indexed. Plain
+// gzip files aren't archives, only .tar.gz and .tgz files are.
+var archiveMimeTypes = map[string]bool{
+	zipMimeType: true,
+	tarMimeType: true,
+	tgzMimeType: true,
+}
+
+func init() {
+	mime.AddExtensionType(".zip", zipMimeType)
+	mime.AddExtensionType(".tar", tarMimeType)
+	mime.AddExtensionType(".tgz", tgzMimeType)
+	mime.AddExtensionType(".gz", gzipMimeType)
+}
+
+// errArchiveTooLarge stops reading an archive once it has used up its
+// extraction budget.
+var errArchiveTooLarge = errors.New("archive exceeds --archive_max_total_size")
+
+// errMemberTooLarge skips a single member that is larger than allowed.
+var errMemberTooLarge = errors.New("archive member exceeds --archive_max_member_size")
+
+func isArchiveMimeType(mt string) bool {
+	return archiveMimeTypes[mt]
+}
+
+// containerPath returns the file on disk holding the document with id. For
+// archive members that is the outermost archive.
+func containerPath(id string) string {
+	if i := strings.Index(id, archiveMember); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// archiveEntry is a regular file inside an archive or other container.
+type archiveEntry struct {
+	name string
+	size int64
+	r    io.Reader
+	// mimeType of the entry when it can't be derived from the name's
+	// extension.
+	mimeType string
+	// modTime of the entry if the container records one.
+	modTime time.Time
+}
+
+// walkArchive calls fn for every regular file in the archive.
+func walkArchive(file, mt string, fn func(archiveEntry) error) error {
+	if mt == zipMimeType {
+		z, err := zip.OpenReader(file)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(archiveEntry{name: f.Name, size: int64(f.UncompressedSize64), r: r, modTime: f.Modified})
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if mt != tarMimeType {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := fn(archiveEntry{name: hdr.Name, size: hdr.Size, r: tr, modTime: hdr.ModTime}); err != nil {
+			return err
+		}
+	}
+}
+
+// getArchiveListing is the FileTranslator for archives. The archive's own
+// document holds the names of its members.
+func getArchiveListing(file string) (string, error) {
+	mt, _ := detectMimeType(file)
+	names := []string{}
+	err := walkArchive(file, mt, func(e archiveEntry) error {
+		names = append(names, e.name)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+// isContainerMimeType returns true for files holding other documents.
+func isContainerMimeType(mt string) bool {
+	return isArchiveMimeType(mt) || mt == mboxMimeType || mt == emailMimeType
+}
+
+// walkContainer calls fn for every document inside a container file.
+func walkContainer(file, mt string, fn func(archiveEntry) error) error {
+	switch mt {
+	case mboxMimeType:
+		return walkMbox(file, fn)
+	case emailMimeType:
+		return walkAttachments(file, fn)
+	}
+	return walkArchive(file, mt, fn)
+}
+
+// indexMembers indexes the documents inside the container file as their own
+// documents under ids of the form id!/member. It returns the ids indexed and
+// removes any left over from an earlier version of the container. The
+// messages of an mbox are always indexed, only their attachments count as
+// archive members.
+func (p *processor) indexMembers(container *FileData, file string) []string {
+	id := container.FullPath
+	members := []string{}
+	depth := 1
+	if container.MimeType == mboxMimeType {
+		depth = 0
+	}
+	if depth <= *archiveDepth {
+		budget := *archiveMaxTotalSize
+		err := p.indexContainer(container, file, depth, &budget, &members)
+		if err != nil {
+			log.Printf("Error indexing members of %q, %v\n", file, err)
+		}
+	}
+
+	old, err := p.meta.Get(id)
+	if err != nil || old == nil {
+		return members
+	}
+	current := map[string]bool{}
+	for _, member := range members {
+		current[member] = true
+	}
+	for _, member := range old.Members {
+		if !current[member] {
+			Debugf("Removing stale archive member %q", member)
+			if err := p.Delete(member); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return members
+}
+
+// indexContainer indexes the members of a container at the given depth.
+// Containers found inside it are indexed as well but only descended into
+// while depth is less than --archive_depth. Members without a modification
+// time of their own get the container's. Every message of an mbox gets a
+// budget of its own so large mailboxes are indexed completely.
+func (p *processor) indexContainer(container *FileData, file string, depth int, budget *int64, members *[]string) error {
+	id := container.FullPath
+	mailbox := container.MimeType == mboxMimeType
+	return walkContainer(file, container.MimeType, func(e archiveEntry) error {
+		if mailbox {
+			messageBudget := *archiveMaxTotalSize
+			budget = &messageBudget
+		}
+		name := strings.TrimPrefix(path.Clean("/"+e.name), "/")
+		memberID := id + archiveMember + name
+		if hiddenPath(name) {
+			Debugf("Skipping hidden archive member %q", memberID)
+			return nil
+		}
+		ext, memberMt, ok := checkMimeTypeByExtension(name)
+		byHeader := !ok && e.mimeType != ""
+		if byHeader {
+			memberMt, ok = e.mimeType, true
+			if exts, _ := mime.ExtensionsByType(memberMt); len(exts) > 0 {
+				ext = exts[0]
+			}
+		}
+		// Members without a known type are extracted and sniffed below.
+		if _, _, handled := p.translatorFor(memberMt); ok && !handled {
+			Debugf("Skipping archive member %q of type %q", memberID, memberMt)
+			return nil
+		}
+		if *maxFileSize >= 0 && e.size > *maxFileSize {
+			Debugf("Skipping archive member %q, too large (%d)", memberID, e.size)
+			return nil
+		}
+
+		// Translators work on files so members get extracted to a temporary
+		// file with the same extension.
+		tmpName, err := tempFileName("goin-member-*" + ext)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpName)
+		size, err := extractMember(e.r, tmpName, *budget)
+		if *archiveMaxTotalSize >= 0 {
+			*budget -= size
+		}
+		if err == errMemberTooLarge {
+			Debugf("Skipping archive member %q, %v", memberID, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mt, method := detectMimeType(tmpName)
+		if byHeader && mt == memberMt {
+			method = detectedByHeader
+		}
+		memberMt = mt
+		ft, _, ok := p.translatorFor(memberMt)
+		if memberMt == "" || !ok {
+			Debugf("Skipping archive member %q of type %q", memberID, memberMt)
+			return nil
+		}
+
+		fd := FileData{}
+		fd.FileName = path.Base(name)
+		fd.FullPath = memberID
+		fd.IndexTime = time.Now()
+		fd.Size = size
+		fd.ModTime = e.modTime
+		if fd.ModTime.IsZero() {
+			fd.ModTime = container.ModTime
+		}
+		fd.MimeType = memberMt
+		fd.MimeDetection = method
+		if fd.Text, err = ft(tmpName); err != nil {
+			log.Printf("Error Processing file %q, %v\n", memberID, err)
+			return nil
+		}
+		ifile := newDocument(&fd, tmpName)
+		Debugf("Indexing %q", memberID)
+		if err := p.Put(&ifile); err != nil {
+			return err
+		}
+		*members = append(*members, memberID)
+		if isContainerMimeType(memberMt) && depth < *archiveDepth {
+			return p.indexContainer(&fd, tmpName, depth+1, budget, members)
+		}
+		return nil
+	})
+}
+
+// extractMember copies r to the file named dst as long as it fits in both
+// the remaining budget and --archive_max_member_size. Sizes recorded in
+// archives can't be trusted so the limits are enforced on the data actually
+// read. Negative limits mean no limit.
+func extractMember(r io.Reader, dst string, budget int64) (int64, error) {
+	limit, tooLarge := budget, errArchiveTooLarge
+	if *archiveMaxTotalSize < 0 {
+		limit = -1
+	}
+	if *archiveMaxMemberSize >= 0 && (limit < 0 || *archiveMaxMemberSize < limit) {
+		limit, tooLarge = *archiveMaxMemberSize, errMemberTooLarge
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return n, err
+	}
+	if limit >= 0 && n > limit {
+		return n, tooLarge
+	}
+	return n, nil
+}
+
+// hiddenPath returns true if any element of the slash separated name is
+// hidden.
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
@@ -8,13 +8,13 @@ import (
 )
 
 type AudioData struct {
-	*FileData
-	Artist string `json:"Artist"`
-	Album  string `json:"Album"`
-	Genre  string `json:"Genre"`
-	Title  string `json:"Title"`
-	Track  int    `json:"Track"`
-	Year   int    `json:"Year"`
+	*FileData `json:""`
+	Artist    string `json:"Artist"`
+	Album     string `json:"Album"`
+	Genre     string `json:"Genre"`
+	Title     string `json:"Title"`
+	Track     int    `json:"Track"`
+	Year      int    `json:"Year"`
 }
 
 func (data *AudioData) Type() string {
@@ -25,14 +25,20 @@ func (data *AudioData) Path() string {
 	return data.FullPath
 }
 
-func (data *AudioData) Analyse() {
+// Analyse reads the audio tags from file.
+func (data *AudioData) Analyse(file string) {
 	//audioFile, err := id3.Open(mp3.FullPath)
-	f, err := os.Open(data.FullPath)
-	audioFile, err := tag.ReadFrom(f)
+	f, err := os.Open(file)
 	if err != nil {
-		panic(err)
+		Debugf("Unable to read tags of %q: %v", data.FullPath, err)
+		return
 	}
 	defer f.Close()
+	audioFile, err := tag.ReadFrom(f)
+	if err != nil {
+		Debugf("Unable to read tags of %q: %v", data.FullPath, err)
+		return
+	}
 
 	data.Artist = audioFile.Artist()
 	data.Title = audioFile.Title()
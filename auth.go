@@ -0,0 +1,219 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Token scopes. Admin tokens can do everything read tokens can.
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+// apiToken is a token allowed to use the http API. Only the sha256 of the
+// token is stored.
+type apiToken struct {
+	name   string
+	scopes []string
+	hash   []byte
+}
+
+func (t *apiToken) allows(scope string) bool {
+	for _, s := range t.scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// readTokens reads a tokens file. Every line holds the name of a token, a
+// comma separated list of its scopes and the hex sha256 of the token,
+// separated by spaces. Empty lines and lines starting with # are skipped. A
+// missing file holds no tokens.
+func readTokens(location string) ([]*apiToken, error) {
+	f, err := os.Open(location)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := []*apiToken{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected a name, scopes and a hash", location, n)
+		}
+		hash, err := hex.DecodeString(parts[2])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid token hash", location, n)
+		}
+		scopes := strings.Split(parts[1], ",")
+		for _, scope := range scopes {
+			if scope != scopeRead && scope != scopeAdmin {
+				return nil, fmt.Errorf("%s:%d: unknown scope %q", location, n, scope)
+			}
+		}
+		tokens = append(tokens, &apiToken{name: parts[0], scopes: scopes, hash: hash})
+	}
+	return tokens, scanner.Err()
+}
+
+func writeTokens(location string, tokens []*apiToken) error {
+	if err := os.MkdirAll(filepath.Dir(location), 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("# name scopes sha256 written by goin token\n")
+	for _, t := range tokens {
+		fmt.Fprintf(&b, "%s %s %s\n", t.name, strings.Join(t.scopes, ","), hex.EncodeToString(t.hash))
+	}
+	return ioutil.WriteFile(location, []byte(b.String()), 0600)
+}
+
+// newToken returns a new random token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticator checks the token of http requests. Tokens are passed as
+// bearer tokens or as the password of basic auth, which browsers prompt
+// for. Without any tokens every request is allowed.
+type authenticator struct {
+	tokens []*apiToken
+}
+
+// token returns the token req was made with or nil.
+func (a *authenticator) token(req *http.Request) *apiToken {
+	var secret string
+	if user, password, ok := req.BasicAuth(); ok {
+		secret = password
+		if secret == "" {
+			secret = user
+		}
+	} else if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		secret = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if secret == "" {
+		return nil
+	}
+	hash := hashToken(secret)
+	var found *apiToken
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(hash, t.hash) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+// require wraps h so it is only called for requests with a token allowing
+// scope.
+func (a *authenticator) require(scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(a.tokens) == 0 {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		t := a.token(req)
+		if t == nil {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="goin"`)
+			http.Error(rw, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !t.allows(scope) {
+			http.Error(rw, fmt.Sprintf("token '%s' lacks the %s scope", t.name, scope), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// ManageTokens runs goin token: add <name> creates a token with the
+// --scope scopes and prints it, rm <name> removes a token and list prints
+// the names and scopes of the tokens.
+func ManageTokens(location string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("goin token needs one of add, rm or list")
+	}
+	tokens, err := readTokens(location)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		for _, t := range tokens {
+			fmt.Printf("%s\t%s\n", t.name, strings.Join(t.scopes, ","))
+		}
+		return nil
+	case "add", "rm":
+		if len(args) != 2 || strings.ContainsAny(args[1], " \t") || args[1] == "" {
+			return fmt.Errorf("goin token %s needs the name of a token", args[0])
+		}
+	default:
+		return fmt.Errorf("unknown token command %q", args[0])
+	}
+	name := args[1]
+	kept := []*apiToken{}
+	for _, t := range tokens {
+		if t.name != name {
+			kept = append(kept, t)
+		}
+	}
+	if args[0] == "rm" {
+		if len(kept) == len(tokens) {
+			return fmt.Errorf("no token named %q", name)
+		}
+		return writeTokens(location, kept)
+	}
+
+	if len(kept) != len(tokens) {
+		return fmt.Errorf("a token named %q already exists", name)
+	}
+	scopes := strings.Split(*tokenScope, ",")
+	for _, scope := range scopes {
+		if scope != scopeRead && scope != scopeAdmin {
+			return fmt.Errorf("unknown scope %q, expected read or admin", scope)
+		}
+	}
+	secret, err := newToken()
+	if err != nil {
+		return err
+	}
+	tokens = append(tokens, &apiToken{name: name, scopes: scopes, hash: hashToken(secret)})
+	if err := writeTokens(location, tokens); err != nil {
+		return err
+	}
+	fmt.Println(secret)
+	return nil
+}
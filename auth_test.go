@@ -0,0 +1,100 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash := hex.EncodeToString(hashToken("secret"))
+	cases := []struct {
+		name    string
+		content string
+		want    []string
+		err     string
+	}{
+		{"tokens", "# comment\n\nlaptop read " + hash + "\nci read,admin " + hash + "\n", []string{"laptop read", "ci read,admin"}, ""},
+		{"missing field", "laptop " + hash + "\n", nil, ":1: expected a name, scopes and a hash"},
+		{"short hash", "laptop read abcd\n", nil, ":1: invalid token hash"},
+		{"bad hex", "laptop read " + strings.Repeat("z", 64) + "\n", nil, ":1: invalid token hash"},
+		{"unknown scope", "\nlaptop write " + hash + "\n", nil, `:2: unknown scope "write"`},
+	}
+	for _, c := range cases {
+		file := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(file, []byte(c.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := readTokens(file)
+		if c.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), c.err) {
+				t.Errorf("%s: got error %v, want one ending in %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		got := []string{}
+		for _, token := range tokens {
+			got = append(got, token.name+" "+strings.Join(token.scopes, ","))
+		}
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%s: got tokens %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	tokens, err := readTokens(filepath.Join(dir, "missing"))
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("missing file: got %v, %v, want no tokens", tokens, err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	tokens := []*apiToken{
+		{name: "reader", scopes: []string{scopeRead}, hash: hashToken("r")},
+		{name: "admin", scopes: []string{scopeAdmin}, hash: hashToken("a")},
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	cases := []struct {
+		name   string
+		tokens []*apiToken
+		scope  string
+		auth   func(req *http.Request)
+		want   int
+	}{
+		{"no tokens configured", nil, scopeAdmin, func(*http.Request) {}, http.StatusOK},
+		{"no token", tokens, scopeRead, func(*http.Request) {}, http.StatusUnauthorized},
+		{"unknown token", tokens, scopeRead, func(req *http.Request) { req.Header.Set("Authorization", "Bearer x") }, http.StatusUnauthorized},
+		{"bearer", tokens, scopeRead, func(req *http.Request) { req.Header.Set("Authorization", "Bearer r") }, http.StatusOK},
+		{"basic password", tokens, scopeRead, func(req *http.Request) { req.SetBasicAuth("me", "r") }, http.StatusOK},
+		{"basic user", tokens, scopeRead, func(req *http.Request) { req.SetBasicAuth("r", "") }, http.StatusOK},
+		{"read token for admin", tokens, scopeAdmin, func(req *http.Request) { req.Header.Set("Authorization", "Bearer r") }, http.StatusForbidden},
+		{"admin token for read", tokens, scopeRead, func(req *http.Request) { req.Header.Set("Authorization", "Bearer a") }, http.StatusOK},
+		{"admin token for admin", tokens, scopeAdmin, func(req *http.Request) { req.Header.Set("Authorization", "Bearer a") }, http.StatusOK},
+	}
+	for _, c := range cases {
+		a := &authenticator{tokens: c.tokens}
+		req := httptest.NewRequest("GET", "/api", nil)
+		c.auth(req)
+		rw := httptest.NewRecorder()
+		a.require(c.scope, ok).ServeHTTP(rw, req)
+		if rw.Code != c.want {
+			t.Errorf("%s: got status %d, want %d", c.name, rw.Code, c.want)
+		}
+	}
+}
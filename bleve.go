@@ -8,15 +8,15 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis"
 	"github.com/blevesearch/bleve/analysis/char/html"
 	"github.com/blevesearch/bleve/analysis/lang/en"
 	"github.com/blevesearch/bleve/index/scorch"
-	"github.com/blevesearch/bleve/mapping"
 	"github.com/blevesearch/bleve/registry"
-	"github.com/blevesearch/bleve/search/highlight/highlighter/ansi"
+	"github.com/blevesearch/bleve/search/query"
 )
 
 const htmlMimeType = "text/html"
@@ -26,51 +26,150 @@ func init() {
 	registry.RegisterAnalyzer(htmlMimeType, func(config map[string]interface{}, cache *registry.Cache) (*analysis.Analyzer, error) {
 		a, err := en.AnalyzerConstructor(config, cache)
 		if err != nil {
-			if cf, err := cache.CharFilterNamed(html.Name); err == nil {
-				a.CharFilters = []analysis.CharFilter{cf}
-			} else {
-				return nil, err
-			}
+			return nil, err
 		}
-
-		return a, err
+		cf, err := cache.CharFilterNamed(html.Name)
+		if err != nil {
+			return nil, err
+		}
+		a.CharFilters = []analysis.CharFilter{cf}
+		return a, nil
 	})
 }
 
-func buildHtmlDocumentMapping() *mapping.DocumentMapping {
-	dm := bleve.NewDocumentMapping()
-	dm.DefaultAnalyzer = htmlMimeType
-	return dm
-}
-
+// Index stores documents. Writes are batched and only guaranteed to be in
+// the index once Flush or Close returns.
 type Index interface {
 	Put(data *IFile) error
+	Delete(path string) error
+	Flush() error
+	Paths() ([]string, error)
 	Query(terms []string) (*bleve.SearchResult, error)
+	Search(request *bleve.SearchRequest) (*bleve.SearchResult, error)
+	// Document returns the stored fields of a document or nil if there is
+	// no document with that id.
+	Document(id string) (map[string]interface{}, error)
+	// SchemaVersion returns the schema version the index was built with.
+	SchemaVersion() (int, error)
 	Close() error
 }
 
 type bleveIndex struct {
 	index bleve.Index
+	// mu guards batch which collects writes until the next Flush.
+	mu    sync.Mutex
+	batch *bleve.Batch
 }
 
 func (i *bleveIndex) Put(data *IFile) error {
-	if err := i.index.Index((*data).Path(), data); err != nil {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	// The document itself is indexed rather than the pointer so bleve can
+	// use its Type to pick the document mapping.
+	if err := i.batch.Index((*data).Path(), *data); err != nil {
+		return fmt.Errorf("Error writing to index: %q", err)
+	}
+	return nil
+}
+
+func (i *bleveIndex) Delete(path string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.batch.Delete(path)
+	return nil
+}
+
+// Flush writes all the pending document changes to the index.
+func (i *bleveIndex) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.batch.Size() == 0 {
+		return nil
+	}
+	Debugf("Writing batch of %d changes", i.batch.Size())
+	if err := i.index.Batch(i.batch); err != nil {
 		return fmt.Errorf("Error writing to index: %q", err)
 	}
+	i.batch.Reset()
 	return nil
 }
 
+// Paths returns the ids of every document in the index.
+func (i *bleveIndex) Paths() ([]string, error) {
+	return documentIDs(i.index)
+}
+
+func documentIDs(index bleve.Index) ([]string, error) {
+	const pageSize = 1000
+	ids := []string{}
+	for {
+		request := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), pageSize, len(ids), false)
+		request.SortBy([]string{"_id"})
+		result, err := index.Search(request)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing index: %q", err)
+		}
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.ID)
+		}
+		if len(result.Hits) < pageSize {
+			return ids, nil
+		}
+	}
+}
+
+// Query searches for terms using the query flags.
 func (i *bleveIndex) Query(terms []string) (*bleve.SearchResult, error) {
-	searchQuery := strings.Join(terms, " ")
-	query := bleve.NewQueryStringQuery(searchQuery)
-	// TODO(jwall): limit, skip, and explain should be configurable.
-	request := bleve.NewSearchRequestOptions(query, *limit, *from, false)
-	if *useHighlight {
-		request.Highlight = bleve.NewHighlightWithStyle(ansi.Name)
-	} else {
-		request.Highlight = bleve.NewHighlight()
+	request, err := queryRequest(terms, *limit, *from)
+	if err != nil {
+		return nil, err
 	}
+	return i.Search(request)
+}
 
+// queryRequest builds the search request for a query string split into
+// terms applying the filter, sort, facet and highlight flags.
+func queryRequest(terms []string, size, from int) (*bleve.SearchRequest, error) {
+	terms, conjuncts := splitDirTerms(terms)
+	filters, err := queryFilters()
+	if err != nil {
+		return nil, err
+	}
+	conjuncts = append(conjuncts, filters...)
+	var q query.Query = bleve.NewMatchAllQuery()
+	if searchQuery := strings.Join(terms, " "); searchQuery != "" {
+		q = bleve.NewQueryStringQuery(searchQuery)
+	}
+	if len(conjuncts) > 0 {
+		q = bleve.NewConjunctionQuery(append(conjuncts, q)...)
+	}
+	// TODO(jwall): explain should be configurable.
+	request := bleve.NewSearchRequestOptions(q, size, from, false)
+	if order := sortOrder(*sortBy); len(order) > 0 {
+		request.SortBy(order)
+	}
+	if err := addFacets(request); err != nil {
+		return nil, err
+	}
+	if style := resultHighlighter(); style != "" {
+		request.Highlight = bleve.NewHighlightWithStyle(style)
+	}
+	if *outputFormat != "text" && *outputFormat != "paths" {
+		request.Fields = resultFields
+	}
+	return request, nil
+}
+
+// resultFields are the stored fields returned with every hit in the formats
+// meant for scripts. Text is left out as it holds the whole document.
+var resultFields = []string{
+	"FullPath", "FileName", "MimeType", "MimeDetection", "IndexTime", "ModTime", "Size",
+	"Artist", "Album", "Genre", "Title", "Year", "Track",
+	"Author", "Created", "Modified",
+	"MessageID", "From", "To", "Cc", "Subject", "Date",
+}
+
+func (i *bleveIndex) Search(request *bleve.SearchRequest) (*bleve.SearchResult, error) {
 	result, err := i.index.Search(request)
 	if err != nil {
 		log.Printf("Search Error: %q", err)
@@ -79,27 +178,56 @@ func (i *bleveIndex) Query(terms []string) (*bleve.SearchResult, error) {
 	return result, nil
 }
 
+func (i *bleveIndex) Document(id string) (map[string]interface{}, error) {
+	doc, err := i.index.Document(id)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	return newStoredDocument(doc), nil
+}
+
+func (i *bleveIndex) SchemaVersion() (int, error) {
+	return schemaVersion(i.index)
+}
+
 func (i *bleveIndex) Close() error {
+	if err := i.Flush(); err != nil {
+		log.Print(err)
+	}
 	return i.index.Close()
 }
-func NewIndex(indexLocation string) (Index, error) {
+
+// NewIndex opens the index at indexLocation creating it if it doesn't exist
+// yet.
+func NewIndex(indexLocation string, readOnly bool) (Index, error) {
+	index, err := openBleveIndex(indexLocation, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	// bleve names indexes after their location and sets the name on every
+	// hit. Only hits of federated searches should name their index.
+	index.SetName("")
+	return &bleveIndex{index: index, batch: index.NewBatch()}, nil
+}
+
+func openBleveIndex(indexLocation string, readOnly bool) (bleve.Index, error) {
 	// TODO(jwall): An abstract indexing interface?
+	if err := recoverIndex(indexLocation); err != nil {
+		return nil, fmt.Errorf("Error recovering index %q: %v", indexLocation, err)
+	}
 	var index bleve.Index
 	if _, err := os.Stat(indexLocation); os.IsNotExist(err) {
-		mapping := bleve.NewIndexMapping()
-		mapping.DefaultAnalyzer = "en"
-		mapping.AddDocumentMapping(htmlMimeType, buildHtmlDocumentMapping())
-		// TODO(jwall): Create document mappings for our custom types.
+		mapping := buildIndexMapping()
 		log.Printf("Creating new index %q", indexLocation)
 		bleve.Config.DefaultIndexType = scorch.Name
 		if index, err = bleve.New(indexLocation, mapping); err != nil {
 			return nil, fmt.Errorf("Error creating index %q\n", err)
 		}
-	} else {
-		readOnly := false
-		if *isQuery {
-			readOnly = true
+		if err := setSchemaVersion(index); err != nil {
+			index.Close()
+			return nil, fmt.Errorf("Error creating index %q\n", err)
 		}
+	} else {
 		opts := map[string]interface{}{
 			"read_only": readOnly,
 		}
@@ -107,6 +235,14 @@ func NewIndex(indexLocation string) (Index, error) {
 		if index, err = bleve.OpenUsing(indexLocation, opts); err != nil {
 			return nil, fmt.Errorf("Error opening index %q\n", err)
 		}
+		// Searching an outdated index mostly works so queries only warn.
+		if err := checkSchema(index, indexLocation); err != nil {
+			if !readOnly {
+				index.Close()
+				return nil, err
+			}
+			log.Printf("Warning: %v", err)
+		}
 	}
-	return &bleveIndex{index}, nil
+	return index, nil
 }
@@ -0,0 +1,510 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a goin subcommand. Its flags are picked by name from the ones
+// defined in flag.go so the deprecated global flags keep working.
+type command struct {
+	name    string
+	args    string
+	summary string
+	flags   [][]string
+	run     func(args []string) error
+}
+
+// Flags shared by several commands.
+var (
+	commonFlags = []string{"config", "profile", "index_location", "meta_location", "hash_location", "socket", "debug"}
+	indexFlags  = []string{
+		"force", "paranoid", "workers", "ocr_workers", "batch_size", "max_file_size",
+		"include", "exclude", "gitignore", "mime",
+		"archive_depth", "archive_max_member_size", "archive_max_total_size",
+		"tess_data_prefix", "tess-debug-file", "pdfdensity", "lang",
+	}
+	searchFlags = []string{
+		"limit", "from", "sort", "since", "until", "min-size", "max-size", "type", "under",
+		"highlight", "highlight_style",
+	}
+)
+
+var commands = []*command{
+	{
+		name:    "index",
+		args:    "<files or directories>",
+		summary: "Index files and directories.",
+		flags:   [][]string{commonFlags, indexFlags, {"watch", "watch_delay", "prune"}},
+		run:     runIndex,
+	},
+	{
+		name:    "query",
+		args:    "<search query>",
+		summary: "Search the index.",
+		flags:   [][]string{commonFlags, {"index"}, searchFlags, {"format", "facet", "facet_size", "drill"}},
+		run:     runQuery,
+	},
+	{
+		name:    "tui",
+		summary: "Search the index interactively.",
+		flags:   [][]string{commonFlags, {"index"}, searchFlags},
+		run:     runTUI,
+	},
+	{
+		name:    "show",
+		args:    "<document ids>",
+		summary: "Print the stored fields of documents.",
+		flags:   [][]string{commonFlags, {"index", "format"}},
+		run:     runShow,
+	},
+	{
+		name:    "stats",
+		summary: "Print the number and types of indexed documents.",
+		flags:   [][]string{commonFlags, {"format", "facet_size"}},
+		run:     runStats,
+	},
+	{
+		name:    "rm",
+		args:    "<files or directories>",
+		summary: "Remove files and everything beneath directories from the index.",
+		flags:   [][]string{commonFlags, {"batch_size"}},
+		run:     runRm,
+	},
+	{
+		name:    "prune",
+		args:    "[files or directories]",
+		summary: "Remove files that no longer exist from the index. Without locations every file in the index is checked.",
+		flags:   [][]string{commonFlags, {"batch_size"}},
+		run:     runPrune,
+	},
+	{
+		name:    "migrate",
+		summary: "Rebuild the index with the current schema. With --force every file is reindexed instead.",
+		flags:   [][]string{commonFlags, indexFlags},
+		run:     runMigrate,
+	},
+	{
+		name:    "token",
+		args:    "add <name> | rm <name> | list",
+		summary: "Manage the tokens allowed to use goin serve. add prints the new token, only its hash is stored.",
+		flags:   [][]string{commonFlags, {"tokens_file", "scope"}},
+		run:     runToken,
+	},
+	{
+		name:    "serve",
+		summary: "Serve the indexes of every profile, or the ones given with --index, over http.",
+		flags:   [][]string{commonFlags, {"index", "listen", "tls_cert", "tls_key", "tokens_file", "cors_origin", "read_only"}, indexFlags},
+		run:     runServe,
+	},
+	{
+		name:    "daemon",
+		summary: "Hold the indexes like serve does on a unix socket that index, query, tui and show use while it runs.",
+		flags:   [][]string{commonFlags, {"index", "read_only"}, indexFlags},
+		run:     runDaemon,
+	},
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// flagSet returns the flags of cmd sharing their values with the global
+// flags of the same name.
+func (cmd *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("goin "+cmd.name, flag.ExitOnError)
+	for _, names := range cmd.flags {
+		for _, name := range names {
+			f := commandFlags.Lookup(name)
+			if f == nil {
+				f = flag.Lookup(name)
+			}
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n\tgoin %s [options] %s\n\n%s\n\nOptions:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Run parses the flags in args and runs the command with the remaining
+// arguments.
+func (cmd *command) Run(args []string) error {
+	fs := cmd.flagSet()
+	fs.SetOutput(os.Stdout)
+	fs.Parse(args)
+	markSetFlags(fs)
+	return runCommand(cmd, fs.Args())
+}
+
+func usage() string {
+	rv := fmt.Sprintln("Usage: \n\tgoin <command> [options] [arguments]") +
+		fmt.Sprintln("") +
+		fmt.Sprintln("Commands:")
+	for _, cmd := range commands {
+		rv += fmt.Sprintf("\t%-8s %s\n", cmd.name, cmd.summary)
+	}
+	return rv + fmt.Sprintln("") +
+		fmt.Sprintln("Run goin <command> --help for the options of a command.") +
+		fmt.Sprintln("") +
+		fmt.Sprintln("The search query is in the syntax documented at: https://github.com/blevesearch/bleve/wiki/Query%20String%20Query.")
+}
+
+// legacyCommand returns the command the deprecated --serve-http, --migrate,
+// --query, --index, --watch and --prune flags ask for along with the name of
+// the flag used.
+func legacyCommand() (*command, string) {
+	switch {
+	case *serveHTTP:
+		return lookupCommand("serve"), "serve-http"
+	case *isMigrate:
+		return lookupCommand("migrate"), "migrate"
+	case *isQuery:
+		return lookupCommand("query"), "query"
+	case *isIndex:
+		return lookupCommand("index"), "index"
+	case *watch:
+		return lookupCommand("index"), "watch"
+	case *isPrune:
+		return lookupCommand("prune"), "prune"
+	}
+	return nil, ""
+}
+
+// runCommand loads the config file, sets up logging and mime types for cmd
+// and runs it.
+func runCommand(cmd *command, args []string) error {
+	if err := loadConfig(*configFile, *profile); err != nil {
+		return err
+	}
+	// Write annoying tesseract stderr to a file
+	// This means everything logged to stderr goes to that file unfortunately.
+	// Setting debug_file for tesseract doesn't seem to work for everything.
+	if !*isDebug {
+		os.Stderr.Close()
+		stderr, err := os.Create("/tmp/goin.err")
+		if err != nil {
+			panic(err)
+		}
+		os.Stderr = stderr
+		defer stderr.Close()
+	}
+
+	for k, v := range mimeTypeMappings {
+		log.Printf("Adding mime-type mapping for extension %q=%q", k, v)
+		mime.AddExtensionType(k, v)
+	}
+	return cmd.run(args)
+}
+
+// openProcessor opens the index for writing along with the metadata store
+// and returns a processor using both. close releases them.
+func openProcessor() (p FileProcessor, close func(), err error) {
+	// The metadata store is opened first as it fails fast when another
+	// process, like goin serve, holds it while the index would block.
+	meta, err := NewMetaStore(*metaLocation)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := NewIndex(*indexLocation, false)
+	if err != nil {
+		meta.Close()
+		return nil, nil, err
+	}
+	if err := MigrateHashDir(*hashLocation, meta, index); err != nil {
+		log.Printf("Error migrating hashes from %q, %v\n", *hashLocation, err)
+	}
+	close = func() {
+		index.Close()
+		meta.Close()
+	}
+	return NewProcessor(meta, index, *force, *paranoid), close, nil
+}
+
+func runIndex(args []string) error {
+	if len(args) == 0 {
+		args = profileRoots
+	}
+	if ok, err := indexThroughDaemon(args); ok || err != nil {
+		return err
+	}
+	p, close, err := openProcessor()
+	if err != nil {
+		return err
+	}
+	defer close()
+	var w *Watcher
+	if *watch {
+		if w, err = NewWatcher(p, *watchDelay); err != nil {
+			return err
+		}
+	}
+	for _, file := range args {
+		fi, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error Stat(ing) file %q, %v\n", file, err)
+			continue
+		}
+		if fi.IsDir() {
+			if w != nil {
+				w.IndexDirectory(absPath(file))
+			} else {
+				IndexDirectory(file, p)
+			}
+		} else if w != nil {
+			w.IndexFile(absPath(file))
+		} else {
+			IndexFile(file, p)
+		}
+	}
+	if err := p.Flush(); err != nil {
+		log.Print(err)
+	}
+	if *isPrune {
+		PruneIndex(args, p)
+	}
+	if w != nil {
+		if err := w.Run(); err != nil {
+			log.Printf("Error watching files, %v\n", err)
+		}
+	}
+	return nil
+}
+
+func runQuery(args []string) error {
+	if _, ok := resultWriters[*outputFormat]; !ok {
+		return fmt.Errorf("Unknown --format %q", *outputFormat)
+	}
+	index, err := openSearchIndex()
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	result, err := index.Query(args)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if err := WriteResults(os.Stdout, *outputFormat, result); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	return nil
+}
+
+func runTUI(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("goin tui takes no arguments")
+	}
+	index, err := openSearchIndex()
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	return RunTUI(index)
+}
+
+func runShow(args []string) error {
+	if *outputFormat != "text" && *outputFormat != "json" {
+		return fmt.Errorf("goin show only supports the text and json formats")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("goin show needs the id of a document")
+	}
+	index, err := openSearchIndex()
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	docs := []map[string]interface{}{}
+	for _, id := range args {
+		doc, err := index.Document(documentID(id))
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return fmt.Errorf("No document %q in the index", documentID(id))
+		}
+		docs = append(docs, doc)
+	}
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(docs)
+	}
+	for i, doc := range docs {
+		if i > 0 {
+			fmt.Println()
+		}
+		writeDocument(os.Stdout, doc)
+	}
+	return nil
+}
+
+// documentID turns a relative path into the id of its document. Ids of
+// archive members are only made absolute up to the archive.
+func documentID(id string) string {
+	if i := strings.Index(id, archiveMember); i >= 0 {
+		return absPath(id[:i]) + id[i:]
+	}
+	return absPath(id)
+}
+
+// writeDocument prints the fields of doc one per line followed by its text.
+func writeDocument(w io.Writer, doc map[string]interface{}) {
+	names := []string{}
+	for name := range doc {
+		if name != "Text" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %v\n", name, formatValue(doc[name]))
+	}
+	if text, ok := doc["Text"]; ok {
+		fmt.Fprintf(w, "\n%v\n", text)
+	}
+}
+
+// formatValue formats times like their json encoding so documents read
+// from the index and from goin daemon print the same.
+func formatValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = formatValue(item)
+		}
+		return values
+	}
+	return v
+}
+
+func runStats(args []string) error {
+	if *outputFormat != "text" && *outputFormat != "json" {
+		return fmt.Errorf("goin stats only supports the text and json formats")
+	}
+	stats, err := statsThroughDaemon()
+	if err != nil {
+		return err
+	}
+	if stats == nil {
+		index, err := NewIndex(*indexLocation, true)
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+		meta, err := NewMetaStore(*metaLocation)
+		if err != nil {
+			return err
+		}
+		defer meta.Close()
+		if stats, err = IndexStats(*indexLocation, index, meta, *facetSize); err != nil {
+			return err
+		}
+	}
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	stats.WriteText(os.Stdout)
+	return nil
+}
+
+func runRm(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("goin rm needs the files or directories to remove")
+	}
+	if err := checkDaemon(); err != nil {
+		return err
+	}
+	p, close, err := openProcessor()
+	if err != nil {
+		return err
+	}
+	defer close()
+	removed, err := p.RemoveAll(args)
+	if err != nil {
+		return err
+	}
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d documents\n", removed)
+	return nil
+}
+
+func runPrune(args []string) error {
+	if err := checkDaemon(); err != nil {
+		return err
+	}
+	p, close, err := openProcessor()
+	if err != nil {
+		return err
+	}
+	defer close()
+	PruneIndex(args, p)
+	return nil
+}
+
+func runMigrate(args []string) error {
+	if err := checkDaemon(); err != nil {
+		return err
+	}
+	meta, err := NewMetaStore(*metaLocation)
+	if err != nil {
+		return err
+	}
+	defer meta.Close()
+	return MigrateIndex(*indexLocation, meta, *force)
+}
+
+func runServe(args []string) error {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("--tls_cert and --tls_key have to be given together")
+	}
+	indexes, err := servedIndexes()
+	if err != nil {
+		return err
+	}
+	tokens, err := readTokens(*tokensFile)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		fmt.Printf("Warning: there are no tokens in %q so anyone who can connect can search and indexing over http is off, add one with goin token add\n", *tokensFile)
+	}
+	s, err := newServer(indexes, tokens, *readOnly)
+	if err != nil {
+		return err
+	}
+	return s.ListenAndServe(*listenAddr, *tlsCert, *tlsKey, *corsOrigins)
+}
+
+func runToken(args []string) error {
+	return ManageTokens(*tokensFile, args)
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// The config file holds settings named like the flags they set. Settings
+// at the top of the file apply to every profile and the ones of the
+// selected profile override them:
+//
+//	default_profile = "docs"
+//	lang = "eng"
+//
+//	[profiles.docs]
+//	index_location = "~/.goin/docs.bleve"
+//	roots = ["~/Documents"]
+//	exclude = ["*.iso"]
+//	max_file_size = "100M"
+//
+//	[profiles.docs.mime]
+//	".org" = "text/plain"
+//
+// Flags passed on the command line override the config file.
+
+// setFlags holds the names of the flags passed on the command line.
+var setFlags = map[string]bool{}
+
+// markSetFlags records the flags that were passed to fs.
+func markSetFlags(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+}
+
+// profileRoots are the roots of the selected profile. goin index indexes
+// them when it isn't given any locations.
+var profileRoots []string
+
+// profileIndexes are the indexes the selected profile searches when no
+// --index is given.
+var profileIndexes []string
+
+// configProfiles and configSettings hold the profiles and the settings
+// shared by all of them from the config file.
+var (
+	configProfiles = map[string]interface{}{}
+	configSettings = map[string]interface{}{}
+)
+
+// notConfigurable are the flags that make no sense in a config file.
+var notConfigurable = map[string]bool{
+	"config": true, "profile": true, "help": true,
+	"index": true, "query": true, "prune": true, "migrate": true, "watch": true, "serve-http": true,
+}
+
+func defaultConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(homeDir, ".config")
+	}
+	return filepath.Join(dir, "goin", "config.toml")
+}
+
+// loadConfig applies the settings of profile from the config file at
+// location to every flag that wasn't passed on the command line. A missing
+// config file is only an error if it or the profile were asked for
+// explicitly.
+func loadConfig(location, profile string) error {
+	settings := map[string]interface{}{}
+	if _, err := toml.DecodeFile(location, &settings); err != nil {
+		if os.IsNotExist(err) && !setFlags["config"] && profile == "" {
+			return nil
+		}
+		return fmt.Errorf("Error reading config file %q: %v", location, err)
+	}
+	profiles := map[string]interface{}{}
+	if p, ok := settings["profiles"]; ok {
+		if profiles, ok = p.(map[string]interface{}); !ok {
+			return fmt.Errorf("Error in config file %q: profiles must be a table", location)
+		}
+		delete(settings, "profiles")
+	}
+	if p, ok := settings["default_profile"]; ok {
+		if profile == "" {
+			profile = fmt.Sprint(p)
+		}
+		delete(settings, "default_profile")
+	}
+	configProfiles = profiles
+	configSettings = map[string]interface{}{}
+	for name, value := range settings {
+		configSettings[name] = value
+	}
+	if profile != "" {
+		p, ok := profiles[profile].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("No profile %q in config file %q", profile, location)
+		}
+		for name, value := range p {
+			settings[name] = value
+		}
+	}
+	Debugf("Using profile %q of %q", profile, location)
+
+	names := []string{}
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := applySetting(name, settings[name]); err != nil {
+			return fmt.Errorf("Error in config file %q: %v", location, err)
+		}
+	}
+	return nil
+}
+
+// applySetting sets the flag name to value unless it was passed on the
+// command line.
+func applySetting(name string, value interface{}) error {
+	if name == "roots" {
+		roots, err := settingStrings(name, value)
+		if err != nil {
+			return err
+		}
+		profileRoots = nil
+		for _, root := range roots {
+			profileRoots = append(profileRoots, expandHome(root))
+		}
+		return nil
+	}
+	if name == "indexes" {
+		indexes, err := settingStrings(name, value)
+		if err != nil {
+			return err
+		}
+		profileIndexes = indexes
+		return nil
+	}
+	f := flag.Lookup(name)
+	if f == nil || notConfigurable[name] {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	if setFlags[name] {
+		return nil
+	}
+	values := []string{}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, expandHome(fmt.Sprint(item)))
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			values = append(values, fmt.Sprintf("%s=%v", k, item))
+		}
+	case string:
+		// Sizes can be given like 100M.
+		if strings.HasSuffix(name, "_size") {
+			n, err := parseSize(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			v = strconv.FormatInt(n, 10)
+		}
+		values = append(values, expandHome(v))
+	default:
+		values = append(values, fmt.Sprint(v))
+	}
+	for _, v := range values {
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+		}
+	}
+	return nil
+}
+
+// profileSetting returns the value of a setting in profile falling back to
+// the settings shared by every profile.
+func profileSetting(profile, name string) (string, error) {
+	if p, ok := configProfiles[profile].(map[string]interface{}); ok {
+		if v, ok := p[name]; ok {
+			return expandHome(fmt.Sprint(v)), nil
+		}
+	}
+	if v, ok := configSettings[name]; ok {
+		return expandHome(fmt.Sprint(v)), nil
+	}
+	return "", fmt.Errorf("profile %q has no %s", profile, name)
+}
+
+// profileStrings returns the values of a list setting in profile falling
+// back to the settings shared by every profile. Paths get expanded.
+func profileStrings(profile, name string) ([]string, error) {
+	value, ok := configSettings[name]
+	if p, pok := configProfiles[profile].(map[string]interface{}); pok {
+		if v, vok := p[name]; vok {
+			value, ok = v, true
+		}
+	}
+	if !ok {
+		return nil, nil
+	}
+	values, err := settingStrings(name, value)
+	if err != nil {
+		return nil, fmt.Errorf("profile %q: %v", profile, err)
+	}
+	for i, v := range values {
+		values[i] = expandHome(v)
+	}
+	return values, nil
+}
+
+func settingStrings(name string, value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list", name)
+	}
+	values := []string{}
+	for _, item := range items {
+		values = append(values, fmt.Sprint(item))
+	}
+	return values, nil
+}
+
+func expandHome(path string) string {
+	if expanded, err := homedir.Expand(path); err == nil {
+		return expanded
+	}
+	return path
+}
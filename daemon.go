@@ -0,0 +1,389 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// goin daemon owns the indexes and serves the same API as goin serve on a
+// unix socket only the user running it can connect to. goin query, tui,
+// show and index talk to it when it's running as the indexes it holds can't
+// be opened by another process.
+
+// runDaemon serves the indexes on the --socket unix socket.
+func runDaemon(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("goin daemon takes no arguments")
+	}
+	if c := dialDaemon(); c != nil {
+		return fmt.Errorf("goin daemon is already running on %q", *socketLocation)
+	}
+	indexes, err := servedIndexes()
+	if err != nil {
+		return err
+	}
+	s, err := newServer(indexes, nil, *readOnly)
+	if err != nil {
+		return err
+	}
+	s.local = true
+	s.router.HandleFunc("/local/indexes", s.serveLocalIndexes).Methods("GET")
+	s.router.HandleFunc("/local/_search", s.serveLocalSearch).Methods("POST")
+	s.router.HandleFunc("/local/stats", s.serveLocalStats).Methods("GET")
+
+	// A socket left behind by a daemon that died is in the way.
+	os.Remove(*socketLocation)
+	if err := os.MkdirAll(filepath.Dir(*socketLocation), 0700); err != nil {
+		s.Close()
+		return err
+	}
+	l, err := net.Listen("unix", *socketLocation)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	if err := os.Chmod(*socketLocation, 0600); err != nil {
+		l.Close()
+		s.Close()
+		return err
+	}
+	fmt.Printf("Serving %d indexes on %s\n", len(s.indexes), *socketLocation)
+	return s.serve(l, s.router, "", "")
+}
+
+// localIndex describes an index held by goin daemon.
+type localIndex struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Writable bool   `json:"writable"`
+}
+
+func (s *server) serveLocalIndexes(rw http.ResponseWriter, req *http.Request) {
+	indexes := []localIndex{}
+	for name, si := range s.indexes {
+		indexes = append(indexes, localIndex{name, absPath(si.location), si.writer != nil})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(indexes)
+}
+
+// serveLocalSearch searches the indexes named by the index parameters
+// together.
+func (s *server) serveLocalSearch(rw http.ResponseWriter, req *http.Request) {
+	indexes := []bleve.Index{}
+	for _, name := range req.URL.Query()["index"] {
+		si, ok := s.indexes[name]
+		if !ok {
+			http.Error(rw, fmt.Sprintf("no such index '%s'", name), http.StatusNotFound)
+			return
+		}
+		indexes = append(indexes, si.index)
+	}
+	if len(indexes) == 0 {
+		http.Error(rw, "no index to search", http.StatusBadRequest)
+		return
+	}
+	var request bleve.SearchRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, fmt.Sprintf("error parsing query: %v", err), http.StatusBadRequest)
+		return
+	}
+	result, err := bleve.NewIndexAlias(indexes...).Search(&request)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error executing query: %v", err), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
+// serveLocalStats writes the stats of the index named by the index
+// parameter. Indexes held read-only have no metadata store so their files
+// aren't counted.
+func (s *server) serveLocalStats(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("index")
+	si, ok := s.indexes[name]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("no such index '%s'", name), http.StatusNotFound)
+		return
+	}
+	size := *facetSize
+	if n, err := strconv.Atoi(req.URL.Query().Get("facet_size")); err == nil {
+		size = n
+	}
+	stats, err := IndexStats(absPath(si.location), &bleveIndex{index: si.index}, si.meta, size)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error reading stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(stats)
+}
+
+// daemonClient talks to goin daemon over its socket.
+type daemonClient struct {
+	client *http.Client
+}
+
+// dialDaemon returns a client for goin daemon or nil if it isn't running.
+func dialDaemon() *daemonClient {
+	conn, err := net.DialTimeout("unix", *socketLocation, time.Second)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	Debugf("Using goin daemon on %q", *socketLocation)
+	socket := *socketLocation
+	return &daemonClient{client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+// do sends a request with body encoded as json and decodes the reply into
+// out. Replies other than 2xx are returned as errors holding their text.
+func (c *daemonClient) do(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://goin"+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error talking to goin daemon: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &daemonError{resp.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type daemonError struct {
+	status int
+	msg    string
+}
+
+func (e *daemonError) Error() string {
+	return "goin daemon: " + e.msg
+}
+
+// heldIndexes returns the indexes at locations as goin daemon holds them or
+// nil if it holds none of them. Holding only some of them is an error as
+// the others can't be searched along with them.
+func (c *daemonClient) heldIndexes(locations []string) ([]localIndex, error) {
+	var held []localIndex
+	if err := c.do("GET", "/local/indexes", nil, &held); err != nil {
+		return nil, err
+	}
+	indexes, missing := []localIndex{}, []string{}
+	for _, location := range locations {
+		found := false
+		for _, li := range held {
+			if li.Location == absPath(location) {
+				indexes, found = append(indexes, li), true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, location)
+		}
+	}
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("goin daemon holds %q but not %q, stop it or have it serve them all", indexes[0].Location, missing[0])
+	}
+	return indexes, nil
+}
+
+// daemonIndex searches indexes held by goin daemon. It can't write to them.
+// Hits only name their index when federated is set, like those of
+// NewIndexAlias.
+type daemonIndex struct {
+	c         *daemonClient
+	names     []string
+	federated bool
+}
+
+var errDaemonReadOnly = fmt.Errorf("goin daemon only searches through this index")
+
+func (d *daemonIndex) Put(data *IFile) error       { return errDaemonReadOnly }
+func (d *daemonIndex) Delete(path string) error    { return errDaemonReadOnly }
+func (d *daemonIndex) Flush() error                { return nil }
+func (d *daemonIndex) Paths() ([]string, error)    { return nil, errDaemonReadOnly }
+func (d *daemonIndex) SchemaVersion() (int, error) { return 0, errDaemonReadOnly }
+func (d *daemonIndex) Close() error                { return nil }
+
+func (d *daemonIndex) Query(terms []string) (*bleve.SearchResult, error) {
+	request, err := queryRequest(terms, *limit, *from)
+	if err != nil {
+		return nil, err
+	}
+	return d.Search(request)
+}
+
+func (d *daemonIndex) Search(request *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	params := url.Values{"index": d.names}
+	result := &bleve.SearchResult{}
+	if err := d.c.do("POST", "/local/_search?"+params.Encode(), request, result); err != nil {
+		return nil, err
+	}
+	if !d.federated {
+		for _, hit := range result.Hits {
+			hit.Index = ""
+		}
+	}
+	return result, nil
+}
+
+// Document returns the document from the first index that has it.
+func (d *daemonIndex) Document(id string) (map[string]interface{}, error) {
+	for _, name := range d.names {
+		var doc struct {
+			Fields storedDocument `json:"fields"`
+		}
+		err := d.c.do("GET", "/api/"+url.PathEscape(name)+"/doc/"+url.PathEscape(id), nil, &doc)
+		if derr, ok := err.(*daemonError); ok && derr.status == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return doc.Fields, nil
+	}
+	return nil, nil
+}
+
+// daemonSearchIndex returns the indexes at locations held by goin daemon
+// to search through it, or nil if it isn't running or doesn't hold them.
+func daemonSearchIndex(locations []string, federated bool) (Index, error) {
+	c := dialDaemon()
+	if c == nil {
+		return nil, nil
+	}
+	indexes, err := c.heldIndexes(locations)
+	if err != nil || indexes == nil {
+		return nil, err
+	}
+	d := &daemonIndex{c: c, federated: federated}
+	for _, li := range indexes {
+		d.names = append(d.names, li.Name)
+	}
+	return d, nil
+}
+
+// daemonHoldingIndex returns a client for goin daemon along with how it
+// holds --index_location, or nil if it isn't running or doesn't hold it.
+func daemonHoldingIndex() (*daemonClient, *localIndex, error) {
+	c := dialDaemon()
+	if c == nil {
+		return nil, nil, nil
+	}
+	indexes, err := c.heldIndexes([]string{*indexLocation})
+	if err != nil || indexes == nil {
+		return nil, nil, err
+	}
+	return c, &indexes[0], nil
+}
+
+// checkDaemon fails when goin daemon holds --index_location for the
+// commands that can only work on the index directly.
+func checkDaemon() error {
+	c, li, err := daemonHoldingIndex()
+	if c == nil {
+		return err
+	}
+	return fmt.Errorf("goin daemon holds this index %q, stop it first", li.Location)
+}
+
+// statsThroughDaemon returns the stats of --index_location from goin
+// daemon or nil if it doesn't hold it.
+func statsThroughDaemon() (*indexStats, error) {
+	c, li, err := daemonHoldingIndex()
+	if c == nil {
+		return nil, err
+	}
+	stats := &indexStats{}
+	params := url.Values{"index": {li.Name}, "facet_size": {fmt.Sprint(*facetSize)}}
+	if err := c.do("GET", "/local/stats?"+params.Encode(), nil, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// indexThroughDaemon has goin daemon index paths into --index_location if
+// it holds it and waits for the job to finish. It returns false if the
+// daemon isn't running or doesn't hold the index.
+func indexThroughDaemon(paths []string) (bool, error) {
+	c, li, err := daemonHoldingIndex()
+	if c == nil {
+		return false, err
+	}
+	if !li.Writable {
+		return true, fmt.Errorf("goin daemon holds %q read-only", li.Location)
+	}
+	if *watch {
+		return true, fmt.Errorf("goin daemon holds %q, stop it first to use --watch", li.Location)
+	}
+	abs := []string{}
+	for _, path := range paths {
+		abs = append(abs, absPath(path))
+	}
+	j := &job{}
+	request := indexRequest{Paths: abs, Force: *force, Prune: *isPrune}
+	if err := c.do("POST", "/api/"+url.PathEscape(li.Name)+"/_index", request, j); err != nil {
+		return true, err
+	}
+	fmt.Printf("Indexing through goin daemon as job %s\n", j.ID)
+	for j.Finished == nil {
+		time.Sleep(500 * time.Millisecond)
+		if err := c.do("GET", "/api/jobs/"+j.ID, nil, j); err != nil {
+			return true, err
+		}
+	}
+	for _, e := range j.Errors {
+		fmt.Printf("Error Processing file %q, %v\n", e.Path, e.Error)
+	}
+	fmt.Printf("%d files processed, %d skipped, %d failed", j.Processed, j.Skipped, j.Failed)
+	if j.Prune {
+		fmt.Printf(", %d pruned", j.Pruned)
+	}
+	fmt.Println()
+	if j.State == jobFailed {
+		return true, fmt.Errorf("job %s failed: %s", j.ID, j.Error)
+	}
+	if j.State != jobDone {
+		return true, fmt.Errorf("job %s was %s", j.ID, j.State)
+	}
+	return true, nil
+}
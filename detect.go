@@ -0,0 +1,212 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The ways a mime type can be detected. They get recorded on each document
+// as MimeDetection.
+const (
+	detectedByExtension = "extension"
+	detectedByMagic     = "magic"
+	detectedByShebang   = "shebang"
+	detectedByMaildir   = "maildir"
+	detectedByContent   = "content"
+	// detectedByHeader is used for email attachments and messages whose type
+	// comes from their Content-Type header.
+	detectedByHeader = "header"
+)
+
+// sniffLen is how much of a file is read to detect its type.
+const sniffLen = 512
+
+// magicSignature identifies a mime type by the bytes at offset.
+type magicSignature struct {
+	offset int
+	magic  []byte
+	mt     string
+}
+
+var magicSignatures = []magicSignature{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{8, []byte("WEBP"), "image/webp"},
+	{0, []byte("ID3"), "audio/mp3"},
+	{8, []byte("M4A "), "audio/mp4a-latm"},
+	{0, []byte("OggS"), "audio/ogg"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{8, []byte("WAVE"), "audio/wav"},
+	{0, []byte("PK\x03\x04"), zipMimeType},
+	{0, []byte("\x1f\x8b\x08"), gzipMimeType},
+	{257, []byte("ustar"), tarMimeType},
+}
+
+// ooxmlParts maps the main part of each OOXML document to its mime type.
+var ooxmlParts = map[string]string{
+	"word/document.xml":    docxMimeType,
+	"xl/workbook.xml":      xlsxMimeType,
+	"ppt/presentation.xml": pptxMimeType,
+}
+
+var emailHeader = regexp.MustCompile(`(?im)^(Received|Return-Path|Message-ID|MIME-Version|Delivered-To|X-Mailer):`)
+
+// checkMimeTypeByExtension returns the extension of name and the mime type
+// registered for it. .tar.gz is the one double extension known.
+func checkMimeTypeByExtension(name string) (string, string, bool) {
+	if strings.HasSuffix(name, ".tar.gz") {
+		return ".tar.gz", tgzMimeType, true
+	}
+	ext := path.Ext(name)
+	mt, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	return ext, mt, err == nil
+}
+
+func readHeader(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, header)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return header[:n], err
+}
+
+// sniffMagic returns the mime type of a file from its magic bytes. Zip files
+// are looked into to tell office documents apart from plain archives.
+func sniffMagic(file string, header []byte) (string, bool) {
+	for _, sig := range magicSignatures {
+		end := sig.offset + len(sig.magic)
+		if len(header) < end || !bytes.Equal(header[sig.offset:end], sig.magic) {
+			continue
+		}
+		if sig.mt != zipMimeType {
+			return sig.mt, true
+		}
+		// OpenDocument files start with an uncompressed mimetype member.
+		if len(header) > 38 && bytes.HasPrefix(header[30:], []byte("mimetypeapplication/vnd.oasis.opendocument.")) {
+			mt := header[38:]
+			if i := bytes.Index(mt, []byte("PK")); i > 0 {
+				mt = mt[:i]
+			}
+			return string(mt), true
+		}
+		if z, err := zip.OpenReader(file); err == nil {
+			defer z.Close()
+			for _, f := range z.File {
+				if mt, ok := ooxmlParts[f.Name]; ok {
+					return mt, true
+				}
+			}
+		}
+		return zipMimeType, true
+	}
+	if bytes.HasPrefix(header, mboxFromLine) && emailHeader.Match(header) {
+		return mboxMimeType, true
+	}
+	return "", false
+}
+
+// sniffShebang returns a text mime type for scripts starting with #!.
+func sniffShebang(header []byte) (string, bool) {
+	if !bytes.HasPrefix(header, []byte("#!")) {
+		return "", false
+	}
+	line := string(header[2:])
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false
+	}
+	interp := filepath.Base(fields[0])
+	if interp == "env" && len(fields) > 1 {
+		interp = fields[1]
+	}
+	switch {
+	case interp == "sh" || strings.HasSuffix(interp, "sh"):
+		return "text/x-shellscript", true
+	case strings.HasPrefix(interp, "python"):
+		return "text/x-python", true
+	case strings.HasPrefix(interp, "node"):
+		return "application/javascript", true
+	}
+	return "text/x-" + strings.TrimRight(interp, "0123456789."), true
+}
+
+// sameFamily returns true when the type from the extension is a more
+// specific form of the type found by magic, like a docx being a zip file.
+func sameFamily(extMt, magicMt string) bool {
+	switch magicMt {
+	case zipMimeType:
+		return isOfficeMimeType(extMt)
+	case gzipMimeType:
+		return extMt == tgzMimeType
+	}
+	return false
+}
+
+// detectMimeType works out the mime type of file and how it was found.
+// Magic bytes win over the extension so misnamed files reach the right
+// translator. Files without a known extension fall back to shebang lines and
+// finally to checking whether the content looks like text.
+func detectMimeType(file string) (string, string) {
+	if isMaildirMessage(file) {
+		return emailMimeType, detectedByMaildir
+	}
+	_, extMt, extOk := checkMimeTypeByExtension(file)
+	header, err := readHeader(file)
+	if err != nil || len(header) == 0 {
+		return extMt, detectedByExtension
+	}
+	if mt, ok := sniffMagic(file, header); ok {
+		if extOk && (extMt == mt || sameFamily(extMt, mt)) {
+			return extMt, detectedByExtension
+		}
+		return mt, detectedByMagic
+	}
+	if extOk {
+		return extMt, detectedByExtension
+	}
+	if mt, ok := sniffShebang(header); ok {
+		return mt, detectedByShebang
+	}
+	if emailHeader.Match(header) && bytes.Contains(header, []byte("\n\n")) {
+		return emailMimeType, detectedByContent
+	}
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(header))
+	if err != nil || mt == "application/octet-stream" {
+		return "", detectedByContent
+	}
+	return mt, detectedByContent
+}
+
+// isPDF returns true for files named or sniffed as pdf.
+func isPDF(file string) bool {
+	if filepath.Ext(file) == ".pdf" {
+		return true
+	}
+	header, err := readHeader(file)
+	return err == nil && bytes.HasPrefix(header, []byte("%PDF-"))
+}
@@ -0,0 +1,344 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emailMimeType = "message/rfc822"
+	mboxMimeType  = "application/mbox"
+)
+
+func init() {
+	mime.AddExtensionType(".eml", emailMimeType)
+	mime.AddExtensionType(".mbox", mboxMimeType)
+}
+
+// isMaildirMessage returns true for the files in the cur and new directories
+// of a Maildir. Their names don't have a useful extension.
+func isMaildirMessage(file string) bool {
+	dir := filepath.Dir(file)
+	switch filepath.Base(dir) {
+	case "cur", "new":
+		fi, err := os.Stat(filepath.Join(filepath.Dir(dir), "tmp"))
+		return err == nil && fi.IsDir()
+	}
+	return false
+}
+
+// isMaildirFolder returns true for the hidden directories Maildir++ keeps
+// the folders other than the inbox in, like .Sent, whose messages
+// isMaildirMessage accepts.
+func isMaildirFolder(dir string) bool {
+	if !strings.HasPrefix(filepath.Base(dir), ".") {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(dir, "tmp"))
+	return err == nil && fi.IsDir()
+}
+
+// EmailData is a single RFC 5322 message.
+type EmailData struct {
+	*FileData `json:""`
+	From      string    `json:"From"`
+	To        []string  `json:"To"`
+	Cc        []string  `json:"Cc"`
+	Subject   string    `json:"Subject"`
+	Date      time.Time `json:"Date"`
+	MessageID string    `json:"MessageID"`
+}
+
+func (data *EmailData) Type() string {
+	return "email"
+}
+
+func (data *EmailData) Path() string {
+	return data.FullPath
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+func decodeHeader(value string) string {
+	if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func addressList(header mail.Header, key string) []string {
+	if header.Get(key) == "" {
+		return nil
+	}
+	addrs, err := header.AddressList(key)
+	if err != nil {
+		return []string{decodeHeader(header.Get(key))}
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.String())
+	}
+	return list
+}
+
+// Analyse reads the message headers from file.
+func (data *EmailData) Analyse(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		Debugf("Unable to read headers of %q: %v", data.FullPath, err)
+		return
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(bufio.NewReader(f))
+	if err != nil {
+		Debugf("Unable to read headers of %q: %v", data.FullPath, err)
+		return
+	}
+	data.From = decodeHeader(msg.Header.Get("From"))
+	if from := addressList(msg.Header, "From"); len(from) > 0 {
+		data.From = from[0]
+	}
+	data.To = addressList(msg.Header, "To")
+	data.Cc = addressList(msg.Header, "Cc")
+	data.Subject = decodeHeader(msg.Header.Get("Subject"))
+	data.Date, _ = msg.Header.Date()
+	data.MessageID = strings.Trim(msg.Header.Get("Message-ID"), "<> ")
+}
+
+// emailVisitor receives the parts of a message.
+type emailVisitor struct {
+	text, html strings.Builder
+	attachment func(name, mt string, r io.Reader) error
+	names      map[string]int
+}
+
+// attach passes an attachment on making sure every name is unique within
+// the message.
+func (v *emailVisitor) attach(name, mt string, r io.Reader) error {
+	if v.attachment == nil {
+		return nil
+	}
+	if name == "" {
+		name = "attachment"
+		if exts, _ := mime.ExtensionsByType(mt); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	name = filepath.Base(name)
+	v.names[name]++
+	if n := v.names[name]; n > 1 {
+		name = fmt.Sprintf("%d-%s", n, name)
+	}
+	return v.attachment(name, mt, r)
+}
+
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// newlineStripper drops line breaks which the base64 decoder doesn't accept.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			out = append(out, b)
+		}
+	}
+	return len(out), err
+}
+
+// walkEmailPart sends the text of a message part to v descending into
+// multipart bodies.
+func walkEmailPart(contentType, encoding, disposition string, body io.Reader, v *emailVisitor) error {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = "text/plain"
+	}
+	body = decodeTransferEncoding(encoding, body)
+	if strings.HasPrefix(mt, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = walkEmailPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part, v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	disp, dparams, _ := mime.ParseMediaType(disposition)
+	name := decodeHeader(dparams["filename"])
+	if name == "" {
+		name = decodeHeader(params["name"])
+	}
+	switch {
+	case disp == "attachment" || name != "" || !strings.HasPrefix(mt, "text/"):
+		return v.attach(name, mt, body)
+	case mt == "text/html":
+		_, err = io.Copy(&v.html, body)
+	default:
+		_, err = io.Copy(&v.text, body)
+	}
+	return err
+}
+
+// walkEmail parses the message in r handing its parts to v.
+func walkEmail(r io.Reader, v *emailVisitor) error {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	contentType := msg.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	return walkEmailPart(contentType, msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body, v)
+}
+
+var htmlSkipped = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+var htmlTag = regexp.MustCompile(`(?s)<[^>]*>`)
+
+func stripHTML(s string) string {
+	s = htmlSkipped.ReplaceAllString(s, " ")
+	s = htmlTag.ReplaceAllString(s, " ")
+	return html.UnescapeString(s)
+}
+
+// getEmailText returns the body of a message preferring the plain text parts
+// over the html ones.
+func getEmailText(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	v := &emailVisitor{names: map[string]int{}}
+	if err := walkEmail(f, v); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(v.text.String()) != "" {
+		return v.text.String(), nil
+	}
+	return stripHTML(v.html.String()), nil
+}
+
+// walkAttachments calls fn for every attachment of the message in file.
+func walkAttachments(file string, fn func(archiveEntry) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v := &emailVisitor{names: map[string]int{}}
+	v.attachment = func(name, mt string, r io.Reader) error {
+		return fn(archiveEntry{name: name, size: -1, r: r, mimeType: mt})
+	}
+	return walkEmail(f, v)
+}
+
+var mboxFromLine = []byte("From ")
+var mboxEscapedFrom = regexp.MustCompile(`^>+From `)
+
+// walkMbox calls fn for every message in an mbox file. Messages are named by
+// their position in the file starting at 1.
+func walkMbox(file string, fn func(archiveEntry) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var msg bytes.Buffer
+	n := 0
+	truncated := false
+	emit := func() error {
+		if n == 0 || truncated {
+			if truncated {
+				log.Printf("Skipping message %d of %q, larger than --archive_max_member_size", n, file)
+			}
+			return nil
+		}
+		return fn(archiveEntry{name: strconv.Itoa(n), size: int64(msg.Len()), r: &msg, mimeType: emailMimeType})
+	}
+	blank := true
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if blank && bytes.HasPrefix(line, mboxFromLine) {
+				if err := emit(); err != nil {
+					return err
+				}
+				msg.Reset()
+				truncated = false
+				n++
+			} else if n > 0 && !truncated {
+				if mboxEscapedFrom.Match(line) {
+					line = line[1:]
+				}
+				msg.Write(line)
+				if *archiveMaxMemberSize >= 0 && int64(msg.Len()) > *archiveMaxMemberSize {
+					truncated = true
+					msg.Reset()
+				}
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err == io.EOF {
+			return emit()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getMboxListing is the FileTranslator for mbox files. The mbox's own
+// document holds the subjects of its messages.
+func getMboxListing(file string) (string, error) {
+	subjects := []string{}
+	err := walkMbox(file, func(e archiveEntry) error {
+		msg, err := mail.ReadMessage(bufio.NewReader(e.r))
+		if err != nil {
+			return nil
+		}
+		subjects = append(subjects, decodeHeader(msg.Header.Get("Subject")))
+		return nil
+	})
+	return strings.Join(subjects, "\n"), err
+}
@@ -0,0 +1,252 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// facetBucket is a named range of a numeric or date range facet. Nil or
+// zero bounds are open.
+type facetBucket struct {
+	name       string
+	min, max   *float64
+	start, end time.Time
+}
+
+// facetSpec is a parsed --facet flag.
+//
+// Field asks for the most common terms of Field, Field:yearly, Field:monthly
+// and Field:daily for date buckets covering the last --facet_size periods
+// and Field:n1,n2,... for numeric buckets split at the given values.
+type facetSpec struct {
+	field   string
+	numeric []facetBucket
+	dates   []facetBucket
+}
+
+var datePeriods = map[string]struct {
+	layout string
+	start  func(time.Time) time.Time
+	next   func(time.Time) time.Time
+}{
+	"yearly": {"2006",
+		func(t time.Time) time.Time { return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()) },
+		func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	"monthly": {"2006-01",
+		func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()) },
+		func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	"daily": {"2006-01-02",
+		func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()) },
+		func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+}
+
+func parseFacet(spec string, size int, now time.Time) (*facetSpec, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	fs := &facetSpec{field: parts[0]}
+	if fs.field == "" {
+		return nil, fmt.Errorf("invalid facet %q, missing field", spec)
+	}
+	if len(parts) == 1 {
+		return fs, nil
+	}
+	if period, ok := datePeriods[parts[1]]; ok {
+		start := period.start(now)
+		for i := 0; i < size; i++ {
+			end := period.next(start)
+			fs.dates = append(fs.dates, facetBucket{name: start.Format(period.layout), start: start, end: end})
+			start = period.start(start.Add(-time.Nanosecond))
+		}
+		fs.dates = append(fs.dates, facetBucket{name: "older", end: period.next(start)})
+		return fs, nil
+	}
+
+	bounds := []float64{}
+	for _, s := range strings.Split(parts[1], ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid facet %q, expected yearly, monthly, daily or a list of numbers", spec)
+		}
+		bounds = append(bounds, f)
+	}
+	sort.Float64s(bounds)
+	var min *float64
+	for i := range bounds {
+		max := &bounds[i]
+		name := fmt.Sprintf("<%g", *max)
+		if min != nil {
+			name = fmt.Sprintf("%g-%g", *min, *max)
+		}
+		fs.numeric = append(fs.numeric, facetBucket{name: name, min: min, max: max})
+		min = max
+	}
+	fs.numeric = append(fs.numeric, facetBucket{name: fmt.Sprintf(">=%g", *min), min: min})
+	return fs, nil
+}
+
+// request returns the bleve facet request for the spec.
+func (fs *facetSpec) request(size int) *bleve.FacetRequest {
+	fr := bleve.NewFacetRequest(fs.field, size)
+	for _, b := range fs.numeric {
+		fr.AddNumericRange(b.name, b.min, b.max)
+	}
+	for _, b := range fs.dates {
+		fr.AddDateTimeRange(b.name, b.start, b.end)
+	}
+	return fr
+}
+
+// filter returns a query matching the documents counted under value. value
+// is the name of one of the spec's buckets or a term.
+func (fs *facetSpec) filter(value string) query.Query {
+	for _, b := range fs.numeric {
+		if b.name == value {
+			q := bleve.NewNumericRangeQuery(b.min, b.max)
+			q.SetField(fs.field)
+			return q
+		}
+	}
+	for _, b := range fs.dates {
+		if b.name == value {
+			q := bleve.NewDateRangeQuery(b.start, b.end)
+			q.SetField(fs.field)
+			return q
+		}
+	}
+	q := bleve.NewTermQuery(value)
+	q.SetField(fs.field)
+	return q
+}
+
+// parseFacets parses the --facet flags.
+func parseFacets() ([]*facetSpec, error) {
+	specs := []*facetSpec{}
+	now := time.Now()
+	for _, spec := range *facets {
+		fs, err := parseFacet(spec, *facetSize, now)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, fs)
+	}
+	return specs, nil
+}
+
+// addFacets adds the facets and drill downs from the --facet and --drill
+// flags to request. Drill downs restrict the results to documents counted
+// under a facet value, given as Field=value.
+func addFacets(request *bleve.SearchRequest) error {
+	specs, err := parseFacets()
+	if err != nil {
+		return err
+	}
+	byField := map[string]*facetSpec{}
+	for _, fs := range specs {
+		request.AddFacet(fs.field, fs.request(*facetSize))
+		byField[fs.field] = fs
+	}
+	if len(*drillDowns) == 0 {
+		return nil
+	}
+	conjuncts := []query.Query{request.Query}
+	for _, drill := range *drillDowns {
+		parts := strings.SplitN(drill, "=", 2)
+		if len(parts) < 2 || parts[0] == "" {
+			return fmt.Errorf("invalid drill down %q, expected Field=value", drill)
+		}
+		fs, ok := byField[parts[0]]
+		if !ok {
+			if err := checkRangeDrill(parts[0], parts[1]); err != nil {
+				return err
+			}
+			fs = &facetSpec{field: parts[0]}
+		}
+		conjuncts = append(conjuncts, fs.filter(parts[1]))
+	}
+	request.Query = bleve.NewConjunctionQuery(conjuncts...)
+	return nil
+}
+
+// rangeFieldType returns the type of field if it is a date or numeric field
+// of the index mapping and "" otherwise.
+func rangeFieldType(field string) string {
+	im := buildIndexMapping()
+	mappings := []*mapping.DocumentMapping{im.DefaultMapping}
+	for _, dm := range im.TypeMapping {
+		mappings = append(mappings, dm)
+	}
+	for _, dm := range mappings {
+		if pm, ok := dm.Properties[field]; ok {
+			for _, fm := range pm.Fields {
+				if fm.Type == "datetime" || fm.Type == "number" {
+					return fm.Type
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// checkRangeDrill returns an error naming the --facet needed to drill down
+// into value of a date or numeric field. Their buckets only exist for a
+// --facet and a term query for value would match nothing.
+func checkRangeDrill(field, value string) error {
+	drill := strconv.Quote(field + "=" + value)
+	switch rangeFieldType(field) {
+	case "datetime":
+		for _, name := range []string{"yearly", "monthly", "daily"} {
+			if _, err := time.Parse(datePeriods[name].layout, value); err == nil {
+				return fmt.Errorf("--drill %s needs --facet %s:%s", drill, field, name)
+			}
+		}
+		return fmt.Errorf("--drill %s needs --facet %s with yearly, monthly or daily", drill, field)
+	case "number":
+		bounds := strings.Split(strings.TrimLeft(value, "<>="), "-")
+		for _, b := range bounds {
+			if _, err := strconv.ParseFloat(b, 64); err != nil {
+				return fmt.Errorf("--drill %s needs --facet %s with the buckets to drill into", drill, field)
+			}
+		}
+		return fmt.Errorf("--drill %s needs --facet %s:%s", drill, field, strings.Join(bounds, ","))
+	}
+	return nil
+}
+
+// sortedFacets returns the facet results ordered by name.
+func sortedFacets(facets search.FacetResults) []string {
+	names := make([]string, 0, len(facets))
+	for name := range facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeFacetsText prints the counts of every facet along with the --drill
+// flag that narrows the results down to it.
+func writeFacetsText(w io.Writer, facets search.FacetResults) {
+	for _, name := range sortedFacets(facets) {
+		fr := facets[name]
+		fmt.Fprintf(w, "\n%s (total %d, missing %d, other %d):\n", name, fr.Total, fr.Missing, fr.Other)
+		for _, t := range fr.Terms {
+			fmt.Fprintf(w, "  %6d  %s\t--drill %s\n", t.Count, t.Term, strconv.Quote(name+"="+t.Term))
+		}
+		for _, r := range fr.NumericRanges {
+			fmt.Fprintf(w, "  %6d  %s\t--drill %s\n", r.Count, r.Name, strconv.Quote(name+"="+r.Name))
+		}
+		for _, r := range fr.DateRanges {
+			fmt.Fprintf(w, "  %6d  %s\t--drill %s\n", r.Count, r.Name, strconv.Quote(name+"="+r.Name))
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import "testing"
+
+func TestCheckRangeDrill(t *testing.T) {
+	cases := []struct {
+		field, value string
+		want         string
+	}{
+		{"ModTime", "2024", `--drill "ModTime=2024" needs --facet ModTime:yearly`},
+		{"Date", "2024-03", `--drill "Date=2024-03" needs --facet Date:monthly`},
+		{"Created", "2024-03-01", `--drill "Created=2024-03-01" needs --facet Created:daily`},
+		{"ModTime", "older", `--drill "ModTime=older" needs --facet ModTime with yearly, monthly or daily`},
+		{"Size", "10-100", `--drill "Size=10-100" needs --facet Size:10,100`},
+		{"Size", "<10", `--drill "Size=<10" needs --facet Size:10`},
+		{"Year", ">=2000", `--drill "Year=>=2000" needs --facet Year:2000`},
+		{"MimeType", "text/plain", ""},
+		{"Artist", "2024", ""},
+	}
+	for _, c := range cases {
+		err := checkRangeDrill(c.field, c.value)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("checkRangeDrill(%q, %q) = %q, want %q", c.field, c.value, got, c.want)
+		}
+	}
+}
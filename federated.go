@@ -0,0 +1,138 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/blevesearch/bleve"
+)
+
+// aliasIndex searches several read-only indexes as one. Hits are merged by
+// score and carry the name of the index they came from in their Index
+// field.
+type aliasIndex struct {
+	alias   bleve.IndexAlias
+	indexes []bleve.Index
+}
+
+// NewIndexAlias opens the indexes at locations read-only under the given
+// names and searches all of them together.
+func NewIndexAlias(names, locations []string) (Index, error) {
+	a := &aliasIndex{}
+	for i, location := range locations {
+		if _, err := os.Stat(location); err != nil {
+			a.Close()
+			return nil, fmt.Errorf("Error opening index %q: %v", names[i], err)
+		}
+		index, err := openBleveIndex(location, true)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		index.SetName(names[i])
+		a.indexes = append(a.indexes, index)
+	}
+	a.alias = bleve.NewIndexAlias(a.indexes...)
+	return a, nil
+}
+
+var errAliasReadOnly = fmt.Errorf("indexes searched together can't be written to")
+
+func (a *aliasIndex) Put(data *IFile) error    { return errAliasReadOnly }
+func (a *aliasIndex) Delete(path string) error { return errAliasReadOnly }
+func (a *aliasIndex) Flush() error             { return errAliasReadOnly }
+
+func (a *aliasIndex) Paths() ([]string, error) {
+	return documentIDs(a.alias)
+}
+
+func (a *aliasIndex) Query(terms []string) (*bleve.SearchResult, error) {
+	request, err := queryRequest(terms, *limit, *from)
+	if err != nil {
+		return nil, err
+	}
+	return a.Search(request)
+}
+
+func (a *aliasIndex) Search(request *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	return (&bleveIndex{index: a.alias}).Search(request)
+}
+
+// Document returns the document from the first index that has it.
+func (a *aliasIndex) Document(id string) (map[string]interface{}, error) {
+	for _, index := range a.indexes {
+		doc, err := index.Document(id)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			return newStoredDocument(doc), nil
+		}
+	}
+	return nil, nil
+}
+
+// SchemaVersion returns the oldest schema version of the indexes.
+func (a *aliasIndex) SchemaVersion() (int, error) {
+	oldest := indexSchemaVersion
+	for _, index := range a.indexes {
+		v, err := schemaVersion(index)
+		if err != nil {
+			return 0, err
+		}
+		if v < oldest {
+			oldest = v
+		}
+	}
+	return oldest, nil
+}
+
+func (a *aliasIndex) Close() error {
+	var err error
+	for _, index := range a.indexes {
+		if cerr := index.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// resolveIndex returns the location of an index given to --index, either
+// the index_location of a profile in the config file or a path.
+func resolveIndex(name string) (string, error) {
+	if _, ok := configProfiles[name]; ok {
+		return profileSetting(name, "index_location")
+	}
+	return expandHome(name), nil
+}
+
+// openSearchIndex opens the indexes to search. Those given with --index or
+// listed under indexes in the profile are searched together, otherwise just
+// --index_location. Indexes held by goin daemon are searched through it.
+func openSearchIndex() (Index, error) {
+	names := []string(*searchIndexes)
+	if len(names) == 0 {
+		names = profileIndexes
+	}
+	locations := []string{}
+	for _, name := range names {
+		location, err := resolveIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	if len(names) == 0 {
+		locations = append(locations, *indexLocation)
+	}
+	if index, err := daemonSearchIndex(locations, len(names) > 0); index != nil || err != nil {
+		return index, err
+	}
+	if len(names) == 0 {
+		return NewIndex(*indexLocation, true)
+	}
+	return NewIndexAlias(names, locations)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
@@ -42,10 +44,13 @@ func defaultTessData() (possible string) {
 	return
 }
 
-func hashFileName(file string) string {
-	dirPath := filepath.Dir(file)
-	prefix := strings.Replace(dirPath, string(filepath.Separator), "_", -1)
-	return prefix + filepath.Base(file)
+// absPath returns the cleaned absolute path of file. Files are always
+// indexed under their absolute path.
+func absPath(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		return abs
+	}
+	return path.Clean(file)
 }
 
 // FileTranslators turn a file into text. The get registered in a FileProcessor
@@ -55,10 +60,13 @@ type FileTranslator func(string) (string, error)
 // TODO(jwall): Okay large file support without having to load the entire file
 // into memory would be nice.
 func getPixImage(f string) (*lpt.Pix, error) {
-	//log.Print("extension: ", filepath.Ext(f))
-	if filepath.Ext(f) == ".pdf" {
+	if isPDF(f) {
 		if cmdName, err := exec.LookPath("convert"); err == nil {
-			tmpFName := filepath.Join(os.TempDir(), filepath.Base(f)+".tif")
+			tmpFName, err := tempFileName(filepath.Base(f) + ".*.tif")
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(tmpFName)
 			Debugf("converting %q to %q", f, tmpFName)
 			cmd := exec.Command(cmdName, "-background", "white", "-flatten", "-alpha", "Off", "-density", fmt.Sprint(*pdfDensity), f, "-depth", "8", tmpFName)
 			out, err := cmd.CombinedOutput()
@@ -75,6 +83,17 @@ func getPixImage(f string) (*lpt.Pix, error) {
 	return lpt.NewPixFromFile(f)
 }
 
+// tempFileName creates an empty temporary file with a unique name matching
+// pattern and returns its name. It is the callers job to remove it.
+func tempFileName(pattern string) (string, error) {
+	fd, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	return fd.Name(), nil
+}
+
 func ocrImageFile(file string) (string, error) {
 	// Create new tess instance and point it to the tessdata location.
 	// Set language to english.
@@ -127,7 +146,8 @@ type IFile interface {
 	Path() string
 }
 
-// FileData represents the data about a file to be indexed.
+// FileData represents the data about a file to be indexed. Types embedding
+// it tag it with `json:""` so bleve indexes its fields at the top level.
 
 type FileData struct {
 	// Full path to the file on disk.
@@ -142,6 +162,10 @@ type FileData struct {
 	Text string `json:"Text"`
 	// Size of the file.
 	Size int64 `json:"Size"`
+	// ModTime is when the file was last modified.
+	ModTime time.Time `json:"ModTime"`
+	// MimeDetection records how MimeType was worked out.
+	MimeDetection string `json:"MimeDetection"`
 }
 
 // Type satisifies the bleve.Classifier interface for FileData.
@@ -158,17 +182,42 @@ type FileProcessor interface {
 	ShouldProcess(file string) (bool, error)
 	Process(file string) error
 	Register(mime string, ft FileTranslator) error
+	// Remove drops a file from the index and forgets its hash.
+	Remove(file string) error
+	// Prune removes files under roots that no longer exist on disk.
+	Prune(roots []string) (int, error)
+	// RemoveAll removes every file under roots.
+	RemoveAll(roots []string) (int, error)
 	// FileProcessors also implement the Index interface.
 	Index
 }
 
 type processor struct {
 	defaultMimeTypeHandlers map[string]FileTranslator
-	hashDir                 string
+	meta                    MetaStore
 	force                   bool
+	paranoid                bool
+	// heavySlots bounds how many expensive translations run at once.
+	heavySlots chan struct{}
+	// mu guards pending, the files whose metadata gets stored on the next
+	// Flush, and detected, the types ShouldProcess found for the files
+	// about to be processed.
+	mu       sync.Mutex
+	pending  map[string]*FileMeta
+	detected map[string]detection
 	Index
 }
 
+// bounded wraps a FileTranslator so that it waits for one of the
+// processor's heavySlots before running.
+func (p *processor) bounded(ft FileTranslator) FileTranslator {
+	return func(file string) (string, error) {
+		p.heavySlots <- struct{}{}
+		defer func() { <-p.heavySlots }()
+		return ft(file)
+	}
+}
+
 func getAudioText(file string) (string, error) {
 	return "audio", nil
 }
@@ -176,7 +225,11 @@ func getAudioText(file string) (string, error) {
 func getPdfText(file string) (string, error) {
 	// 1. try pdftotext if it exists.
 	if cmdName, err := exec.LookPath("pdftotext"); err == nil {
-		tmpName := filepath.Join(os.TempDir(), filepath.Base(file)+".txt")
+		tmpName, err := tempFileName(filepath.Base(file) + ".*.txt")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmpName)
 		cmd := exec.Command(cmdName, file, tmpName)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
@@ -196,19 +249,41 @@ func getPdfText(file string) (string, error) {
 func (p *processor) registerDefaults() {
 	p.defaultMimeTypeHandlers = map[string]FileTranslator{
 		"text":                   getPlainTextContent,
-		"image":                  ocrImageFile,
+		"image":                  p.bounded(ocrImageFile),
 		"application/javascript": getPlainTextContent,
 		"application/json":       getPlainTextContent,
 		"application/xml":        getPlainTextContent,
-		"application/pdf":        getPdfText,
+		"application/pdf":        p.bounded(getPdfText),
 		"audio/mp3":              getAudioText,
 		"audio/mp4a-latm":        getAudioText,
+		emailMimeType:            getEmailText,
+		mboxMimeType:             getMboxListing,
+	}
+	for mt, ft := range officeTranslators {
+		p.defaultMimeTypeHandlers[mt] = ft
+	}
+	for mt := range archiveMimeTypes {
+		p.defaultMimeTypeHandlers[mt] = getArchiveListing
 	}
-
 }
 
-func NewProcessor(hashDir string, index Index, force bool) FileProcessor {
-	p := &processor{hashDir: hashDir, Index: index, force: force}
+// NewProcessor returns a FileProcessor that writes to index. Files are always
+// processed if force is true. If paranoid is true files are hashed to detect
+// changes even when their size and modification time are unchanged.
+func NewProcessor(meta MetaStore, index Index, force, paranoid bool) FileProcessor {
+	slots := *ocrWorkers
+	if slots < 1 {
+		slots = 1
+	}
+	p := &processor{
+		meta:       meta,
+		Index:      index,
+		force:      force,
+		paranoid:   paranoid,
+		heavySlots: make(chan struct{}, slots),
+		pending:    map[string]*FileMeta{},
+		detected:   map[string]detection{},
+	}
 	p.registerDefaults()
 	return p
 }
@@ -236,134 +311,232 @@ func hashFile(file string) ([]byte, error) {
 	return h.Sum([]byte{}), nil
 }
 
-func (p *processor) checkHash(file string, hash []byte) (bool, error) {
-	hashFile := path.Join(p.hashDir, hashFileName(file))
-	Debugf("Checking for hashfile %q", hashFile)
-	if _, err := os.Stat(hashFile); os.IsNotExist(err) {
-		return false, nil
-	}
-	f, err := os.Open(hashFile)
-	defer f.Close()
-	if err != nil {
+// unchanged returns true if file is the same as when it was last indexed.
+// Unless the processor is paranoid a file with the same size and
+// modification time is assumed to be unchanged without hashing it.
+func (p *processor) unchanged(file string, fi os.FileInfo) (bool, error) {
+	meta, err := p.meta.Get(file)
+	if err != nil || meta == nil {
 		return false, err
 	}
-	bs, err := ioutil.ReadAll(f)
+	if !p.paranoid && meta.Size == fi.Size() && meta.ModTime.Equal(fi.ModTime()) {
+		Debugf("Size and modification time unchanged for %q", file)
+		return true, nil
+	}
+	Debugf("Checking stored hash for %q", file)
+	h, err := hashFile(file)
 	if err != nil {
 		return false, err
 	}
-	if len(bs) != len(hash) {
+	if !bytes.Equal(meta.Hash, h) {
 		return false, nil
 	}
-	for i, b := range bs {
-		if b != hash[i] {
-			return false, nil
+	// The file was touched without changing. Remember the new modification
+	// time so the next check can skip hashing.
+	if meta.Size != fi.Size() || !meta.ModTime.Equal(fi.ModTime()) {
+		meta.Size = fi.Size()
+		meta.ModTime = fi.ModTime()
+		if err := p.meta.Put(file, meta); err != nil {
+			return true, err
 		}
 	}
 	return true, nil
 }
 
-func (p *processor) finishFile(file string) error {
-	h, err := hashFile(file)
-	if err != nil {
+// Remove deletes a file from the index along with its stored metadata so it
+// will be reprocessed if it ever shows up again.
+func (p *processor) Remove(file string) error {
+	file = absPath(file)
+	Debugf("Removing %q", file)
+	p.mu.Lock()
+	delete(p.pending, file)
+	p.mu.Unlock()
+	if err := p.Delete(file); err != nil {
 		return err
 	}
-
-	if _, err := os.Stat(p.hashDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(p.hashDir, os.ModeDir|os.ModePerm); err != nil {
-			return err
-		}
-	}
-
-	fd, err := os.Create(filepath.Join(p.hashDir, hashFileName(file)))
-	defer fd.Close()
+	meta, err := p.meta.Get(file)
 	if err != nil {
 		return err
 	}
-
-	_, err = fd.Write(h)
-	return err
+	if meta != nil {
+		for _, member := range meta.Members {
+			if err := p.Delete(member); err != nil {
+				return err
+			}
+		}
+	}
+	return p.meta.Delete(file)
 }
 
 // ShouldProcess returns true, nil if the file should be processed.
-// false, error if it should not be processed.
+// false, error if it should not be processed. Files that are unchanged since
+// they were indexed are skipped before their contents are read to detect
+// their type.
 func (p *processor) ShouldProcess(file string) (bool, error) {
 	if strings.HasPrefix(file, ".") {
 		return false, printError("not processing hidden file %q", file)
 	}
 	fi, err := os.Stat(file)
-	if _, mt, ok := p.checkMimeType(file); !ok {
-		return ok, printError("unhandled FileType '%q' for %s", mt, file)
+	if err != nil {
+		return false, err
 	}
-	if p.force && fi.Size() > *maxFileSize {
+	if *maxFileSize >= 0 && fi.Size() > *maxFileSize {
 		return false, printError("file too large to index %q size=(%d)", file, fi.Size())
 	}
-
-	h, err := hashFile(file)
-	if err != nil {
-		return false, err
+	if !p.force {
+		ok, err := p.unchanged(file, fi)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			Debugf("Already indexed %q", file)
+			return false, nil
+		}
 	}
-	if ok, _ := p.checkHash(file, h); ok {
-		Debugf("Already indexed %q", file)
-		return false, nil
+	d := p.detect(file)
+	if d.ft == nil {
+		return false, printError("unhandled FileType '%q' for %s", d.mt, file)
 	}
+	p.mu.Lock()
+	p.detected[file] = d
+	p.mu.Unlock()
 	return true, nil
 }
 
-func (p *processor) checkMimeType(file string) (FileTranslator, string, bool) {
-	// TODO(jwall): Do I want to do anything with the params?
-	// Check to see if this is a handleable file
-	mt, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(file)))
-	if err != nil {
-		return nil, mt, false
+// detection is the mime type of a file, how it was detected and the
+// FileTranslator for it, if there is one.
+type detection struct {
+	ft     FileTranslator
+	mt     string
+	method string
+}
+
+func (p *processor) detect(file string) detection {
+	mt, method := detectMimeType(file)
+	if mt == "" {
+		return detection{nil, mt, method}
+	}
+	ft, _, _ := p.translatorFor(mt)
+	return detection{ft, mt, method}
+}
+
+// detection returns what ShouldProcess detected about file, detecting it
+// again if it wasn't asked about file.
+func (p *processor) detection(file string) detection {
+	p.mu.Lock()
+	d, ok := p.detected[file]
+	delete(p.detected, file)
+	p.mu.Unlock()
+	if !ok {
+		d = p.detect(file)
 	}
+	return d
+}
+
+// translatorFor returns the FileTranslator for a mime type and the name it
+// was registered under.
+func (p *processor) translatorFor(mt string) (FileTranslator, string, bool) {
 	parts := strings.SplitN(mt, "/", 2)
 	if ft, exists := p.defaultMimeTypeHandlers[mt]; exists {
 		return ft, mt, exists
 	} else if ft, exists := p.defaultMimeTypeHandlers[parts[0]]; exists {
-		return ft, mt, exists
+		return ft, parts[0], exists
 	} else {
-		return nil, mt, false //fmt.Errorf("Unhandled file format %q", mt)
+		return nil, "", false //fmt.Errorf("Unhandled file format %q", mt)
 	}
 }
 
-// Process indexes a file.
+// newDocument wraps fd in the document type for its mime type. file is
+// where the contents of the document can be read from.
+func newDocument(fd *FileData, file string) IFile {
+	if fd.MimeType == "audio/mp3" || fd.MimeType == "audio/mp4a-latm" {
+		audio := AudioData{}
+		audio.FileData = fd
+		audio.Analyse(file)
+		return &audio
+	} else if isOfficeMimeType(fd.MimeType) {
+		office := OfficeData{}
+		office.FileData = fd
+		office.Analyse(file)
+		return &office
+	} else if fd.MimeType == emailMimeType {
+		email := EmailData{}
+		email.FileData = fd
+		email.Analyse(file)
+		return &email
+	}
+	return fd
+}
+
+// Process indexes a file. The hash, size and modification time recorded
+// for it are taken before its text is extracted so a file changing while it
+// is indexed is seen as changed the next time.
 func (p *processor) Process(file string) error {
 	fi, err := os.Stat(file)
-	if os.IsNotExist(err) {
-		return err // In theory this will never happen
+	if err != nil {
+		return err
 	}
-	ft, mt, ok := p.checkMimeType(file)
-	if !ok {
-		return printError("unhandled file format %q", mt)
+	d := p.detection(file)
+	if d.ft == nil {
+		return printError("unhandled file format %q", d.mt)
+	}
+	ft, mt, method := d.ft, d.mt, d.method
+	hash, err := hashFile(file)
+	if err != nil {
+		return err
 	}
 
-	var ifile IFile
 	fd := FileData{}
 	fd.FileName = filepath.Base(file)
-	fd.FullPath = path.Clean(file)
+	fd.FullPath = absPath(file)
 	fd.IndexTime = time.Now()
 	fd.Size = fi.Size()
+	fd.ModTime = fi.ModTime()
 
 	fd.MimeType = mt
+	fd.MimeDetection = method
+	Debugf("Detected %q as %q by %s", file, mt, method)
 	fd.Text, err = ft(file)
 	if err != nil {
 		return err
 	}
 
-	if mt == "audio/mp3" || mt == "audio/mp4a-latm" {
-		audio := AudioData{}
-		audio.FileData = &fd
-		audio.Analyse()
-		ifile = &audio
-	} else {
-		ifile = &fd
-	}
-
+	ifile := newDocument(&fd, file)
 	parts := strings.SplitN(mt, "/", 2)
 	Debugf("Detected mime category: %q", parts[0])
 	Debugf("Indexing %q", ifile.Path())
 	if err := p.Put(&ifile); err != nil {
 		return err
 	}
-	return p.finishFile(ifile.Path())
+	_, translator, _ := p.translatorFor(mt)
+	meta := &FileMeta{
+		Hash: hash, Size: fd.Size, ModTime: fd.ModTime,
+		MimeType: mt, Translator: translator, IndexTime: fd.IndexTime,
+	}
+	if isContainerMimeType(mt) {
+		meta.Members = p.indexMembers(&fd, file)
+	}
+	p.mu.Lock()
+	p.pending[ifile.Path()] = meta
+	full := len(p.pending) >= *batchSize
+	p.mu.Unlock()
+	if full {
+		return p.Flush()
+	}
+	return nil
+}
+
+// Flush writes pending documents to the index and then records the metadata
+// of their files so a crash never marks a file as indexed when it isn't.
+func (p *processor) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.Index.Flush(); err != nil {
+		return err
+	}
+	if err := p.meta.PutAll(p.pending); err != nil {
+		return err
+	}
+	p.pending = map[string]*FileMeta{}
+	return nil
 }
@@ -0,0 +1,184 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// sortAliases maps the names accepted by --sort to index fields.
+var sortAliases = map[string]string{
+	"score": "_score",
+	"mtime": "ModTime",
+	"path":  "_id",
+}
+
+// sortOrder turns a comma separated --sort value into bleve sort fields.
+// A leading - reverses the order, except for score which is highest first
+// unless reversed.
+func sortOrder(s string) []string {
+	order := []string{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		if alias, ok := sortAliases[field]; ok {
+			field = alias
+		}
+		if field == "_score" {
+			desc = !desc
+		}
+		if desc {
+			field = "-" + field
+		}
+		order = append(order, field)
+	}
+	return order
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// parseSize parses a size in bytes with an optional k, m, g or t suffix.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimRight(strings.ToLower(strings.TrimSpace(s)), "b")
+	unit := strings.TrimLeft(num, "0123456789.")
+	n, err := strconv.ParseFloat(strings.TrimSuffix(num, unit), 64)
+	mult, ok := sizeUnits[unit]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02", "2006-01", "2006"}
+
+// parseTime parses a date or a time relative to now such as 36h, 7d or 2w.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if len(s) > 1 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		switch s[len(s)-1] {
+		case 'd':
+			if err == nil {
+				return now.AddDate(0, 0, -n), nil
+			}
+		case 'w':
+			if err == nil {
+				return now.AddDate(0, 0, -7*n), nil
+			}
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a date like 2006-01-02 or an age like 7d", s)
+}
+
+// typeQuery matches documents of the given type. A type with a slash is a
+// full mime type, anything else matches either every mime type starting
+// with it, like image, or the mime type of that extension, like pdf.
+func typeQuery(t string) query.Query {
+	if strings.Contains(t, "/") {
+		q := bleve.NewTermQuery(t)
+		q.SetField("MimeType")
+		return q
+	}
+	prefix := bleve.NewPrefixQuery(t + "/")
+	prefix.SetField("MimeType")
+	disjuncts := []query.Query{prefix}
+	if _, mt, ok := checkMimeTypeByExtension("." + t); ok {
+		ext := bleve.NewTermQuery(mt)
+		ext.SetField("MimeType")
+		disjuncts = append(disjuncts, ext)
+	}
+	return bleve.NewDisjunctionQuery(disjuncts...)
+}
+
+// queryFilters returns the queries for the --since, --until, --min-size,
+// --max-size, --type and --under flags. Results have to match all of them.
+func queryFilters() ([]query.Query, error) {
+	filters := []query.Query{}
+	now := time.Now()
+	var since, until time.Time
+	var err error
+	if *sinceFlag != "" {
+		if since, err = parseTime(*sinceFlag, now); err != nil {
+			return nil, err
+		}
+	}
+	if *untilFlag != "" {
+		if until, err = parseTime(*untilFlag, now); err != nil {
+			return nil, err
+		}
+	}
+	if !since.IsZero() || !until.IsZero() {
+		q := bleve.NewDateRangeQuery(since, until)
+		q.SetField("ModTime")
+		filters = append(filters, q)
+	}
+
+	var min, max *float64
+	if *minSize != "" {
+		n, err := parseSize(*minSize)
+		if err != nil {
+			return nil, err
+		}
+		f := float64(n)
+		min = &f
+	}
+	if *maxSize != "" {
+		n, err := parseSize(*maxSize)
+		if err != nil {
+			return nil, err
+		}
+		f := float64(n)
+		max = &f
+	}
+	if min != nil || max != nil {
+		inclusive := true
+		q := bleve.NewNumericRangeInclusiveQuery(min, max, &inclusive, &inclusive)
+		q.SetField("Size")
+		filters = append(filters, q)
+	}
+
+	if len(*typeFilters) > 0 {
+		types := []query.Query{}
+		for _, t := range *typeFilters {
+			for _, t := range strings.Split(t, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					types = append(types, typeQuery(t))
+				}
+			}
+		}
+		filters = append(filters, bleve.NewDisjunctionQuery(types...))
+	}
+	if len(*underDirs) > 0 {
+		dirs := []query.Query{}
+		for _, dir := range *underDirs {
+			dirs = append(dirs, dirQuery(dir))
+		}
+		filters = append(filters, bleve.NewDisjunctionQuery(dirs...))
+	}
+	return filters, nil
+}
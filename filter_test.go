@@ -0,0 +1,69 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"100", 100, true},
+		{"10k", 10 << 10, true},
+		{"10K", 10 << 10, true},
+		{"10kb", 10 << 10, true},
+		{"1.5m", 3 << 19, true},
+		{"2g", 2 << 30, true},
+		{"1t", 1 << 40, true},
+		{" 5 ", 5, true},
+		{"12b", 12, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"10x", 0, false},
+		{"-5", 0, false},
+		{"1.2.3k", 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseSize(c.s)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, ok %v", c.s, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+	cases := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"2023", time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local), true},
+		{"2023-06", time.Date(2023, 6, 1, 0, 0, 0, 0, time.Local), true},
+		{"2023-06-02", time.Date(2023, 6, 2, 0, 0, 0, 0, time.Local), true},
+		{"2023-06-02 10:30", time.Date(2023, 6, 2, 10, 30, 0, 0, time.Local), true},
+		{"2023-06-02T10:30:15", time.Date(2023, 6, 2, 10, 30, 15, 0, time.Local), true},
+		{"2023-06-02T10:30:15Z", time.Date(2023, 6, 2, 10, 30, 15, 0, time.UTC), true},
+		{"7d", now.AddDate(0, 0, -7), true},
+		{"2w", now.AddDate(0, 0, -14), true},
+		{"36h", now.Add(-36 * time.Hour), true},
+		{"90m", now.Add(-90 * time.Minute), true},
+		{"", time.Time{}, false},
+		{"d", time.Time{}, false},
+		{"xd", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+		{"2023-13-01", time.Time{}, false},
+	}
+	for _, c := range cases {
+		got, err := parseTime(c.s, now)
+		if (err == nil) != c.ok || !got.Equal(c.want) {
+			t.Errorf("parseTime(%q) = %v, %v, want %v, ok %v", c.s, got, err, c.want, c.ok)
+		}
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"flag"
 	"fmt"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 )
@@ -27,6 +29,34 @@ func (v StringMapFlag) Set(s string) error {
 	return nil
 }
 
+// StringSliceFlag collects every value passed to a repeatable flag.
+type StringSliceFlag []string
+
+func (v *StringSliceFlag) String() string {
+	return fmt.Sprint([]string(*v))
+}
+
+func (v *StringSliceFlag) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+func sliceFlag(name, usage string) *StringSliceFlag {
+	values := &StringSliceFlag{}
+	flag.Var(values, name, usage)
+	return values
+}
+
+// commandFlags holds the flags of subcommands whose names are taken by the
+// deprecated global flags.
+var commandFlags = flag.NewFlagSet("goin", flag.ExitOnError)
+
+func commandSliceFlag(name, usage string) *StringSliceFlag {
+	values := &StringSliceFlag{}
+	commandFlags.Var(values, name, usage)
+	return values
+}
+
 func mimeFlag(name, usage string) StringMapFlag {
 	mimeTypeMappings := StringMapFlag{}
 	flag.Var(mimeTypeMappings, name, usage)
@@ -38,17 +68,55 @@ var homeDir, _ = homedir.Dir()
 var tessData = flag.String("tess_data_prefix", defaultTessData(), "Location of the tesseract data.")
 var tessDebugFile = flag.String("tess-debug-file", "/dev/null", "Write tesseract debug output to file.")
 var help = flag.Bool("help", false, "Show this help.")
+var configFile = flag.String("config", defaultConfigFile(), "Location of the config file.")
+var profile = flag.String("profile", "", "Profile of the config file to use. Defaults to its default_profile.")
 var pdfDensity = flag.Int("pdfdensity", 300, "density to use when converting pdf's to tiffs.")
 var tesseractLang = flag.String("lang", "eng", "Tesseract language to use.")
 var indexLocation = flag.String("index_location", filepath.Join(homeDir, ".goin/index.bleve"), "Location for the bleve index.")
-var hashLocation = flag.String("hash_location", filepath.Join(homeDir, ".goin/indexed_files"), "Location where the indexed file hashes are stored.")
-var isQuery = flag.Bool("query", false, "Run a query instead of indexing")
+var hashLocation = flag.String("hash_location", filepath.Join(homeDir, ".goin/indexed_files"), "Location of the old per-file hash directory. It is migrated into --meta_location on first use.")
+var metaLocation = flag.String("meta_location", filepath.Join(homeDir, ".goin/files.db"), "Location of the store for indexed file metadata.")
+var isQuery = flag.Bool("query", false, "Deprecated: use goin query.")
 var isDebug = flag.Bool("debug", false, "Verbose logging")
 var limit = flag.Int("limit", 10, "Limit query result to this number of item.")
 var from = flag.Int("from", 0, "Start returning at this item.")
-var isIndex = flag.Bool("index", false, "Run an indexing operation instead of querying")
+var isIndex = flag.Bool("index", false, "Deprecated: use goin index.")
+var isMigrate = flag.Bool("migrate", false, "Deprecated: use goin migrate.")
+var isPrune = flag.Bool("prune", false, "Remove files that no longer exist from the index after indexing.")
+var watch = flag.Bool("watch", false, "Keep running after indexing and reindex files as they change.")
+var watchDelay = flag.Duration("watch_delay", 2*time.Second, "How long a file must stop changing before --watch reindexes it.")
+var workers = flag.Int("workers", runtime.NumCPU(), "Number of files to index concurrently.")
+var ocrWorkers = flag.Int("ocr_workers", 1, "Number of OCR and pdf conversions to run concurrently.")
+var batchSize = flag.Int("batch_size", 100, "Number of documents to write to the index at once.")
 var mimeTypeMappings = mimeFlag("mime", "Add a custom mime type mapping.")
+var includePatterns = sliceFlag("include", "Only index files matching this gitignore style pattern. Can be repeated.")
+var excludePatterns = sliceFlag("exclude", "Skip paths matching this gitignore style pattern. Can be repeated.")
+var useGitignore = flag.Bool("gitignore", false, "Also skip files matched by .gitignore files when indexing.")
+var archiveDepth = flag.Int("archive_depth", 2, "How many levels of nested archives to index the members of. 0 disables indexing archive members.")
+var archiveMaxMemberSize = flag.Int64("archive_max_member_size", 100<<20, "Maximum uncompressed size of an archive member to index. A size of -1 means no limit.")
+var archiveMaxTotalSize = flag.Int64("archive_max_total_size", 1<<30, "Maximum total uncompressed size to extract from a single archive. A size of -1 means no limit.")
 var maxFileSize = flag.Int64("max_file_size", -1, "Maximum size of file to index. A size of -1 means no limit.")
 var force = flag.Bool("force", false, "Force an index even if the file hasn't changed")
+var paranoid = flag.Bool("paranoid", false, "Always hash files to detect changes instead of trusting their size and modification time")
 var useHighlight = flag.Bool("highlight", true, "Whether to highlight results in the output")
-var serveHTTP = flag.Bool("serve-http", false, "Whether serve the index via http")
+var highlightStyle = flag.String("highlight_style", "", "How to highlight matches: ansi, html or plain. Defaults to ansi for text written to a terminal and plain otherwise.")
+var facets = sliceFlag("facet", "Count the results by a field. Field for its terms, Field:yearly, Field:monthly or Field:daily for dates and Field:n1,n2,... for numeric ranges. Can be repeated.")
+var facetSize = flag.Int("facet_size", 10, "Number of terms or date periods to show for each --facet.")
+var drillDowns = sliceFlag("drill", "Only return results counted under a facet value, given as Field=value. Can be repeated.")
+var sortBy = flag.String("sort", "", "Comma separated fields to order results by, like -mtime,FileName. A leading - reverses the order. Accepts score, mtime, path and any indexed field. Defaults to score.")
+var sinceFlag = flag.String("since", "", "Only return files modified at or after this date (2006-01-02) or age (36h, 7d, 2w).")
+var untilFlag = flag.String("until", "", "Only return files modified before this date or age.")
+var minSize = flag.String("min-size", "", "Only return files of at least this size, like 10k or 5M.")
+var maxSize = flag.String("max-size", "", "Only return files of at most this size.")
+var typeFilters = sliceFlag("type", "Only return files of this mime type (text/plain), mime type prefix (image) or extension (pdf). Can be repeated.")
+var underDirs = sliceFlag("under", "Only return files beneath this directory. Can be repeated.")
+var searchIndexes = commandSliceFlag("index", "Index to search, given as its location or the name of a profile in the config file. Can be repeated to search several indexes at once.")
+var outputFormat = flag.String("format", "text", "Format of query results: text, json, ndjson, csv or paths.")
+var listenAddr = flag.String("listen", "localhost:8080", "Address for goin serve to listen on.")
+var tlsCert = flag.String("tls_cert", "", "Certificate file for goin serve to use https with. Needs --tls_key.")
+var tlsKey = flag.String("tls_key", "", "Key file of the --tls_cert certificate.")
+var tokensFile = flag.String("tokens_file", filepath.Join(filepath.Dir(defaultConfigFile()), "tokens"), "File with the hashed tokens allowed to use goin serve. Without tokens anyone who can connect can use it.")
+var corsOrigins = sliceFlag("cors_origin", "Origin allowed to call goin serve from other web pages, like https://example.com. Can be repeated.")
+var tokenScope = flag.String("scope", scopeRead, "Comma separated scopes of a new token: read to search and fetch documents, admin for everything.")
+var readOnly = flag.Bool("read_only", false, "Serve the indexes read-only, without the endpoints to index and delete documents.")
+var socketLocation = flag.String("socket", filepath.Join(homeDir, ".goin/goin.sock"), "Unix socket goin daemon listens on and the other commands look for it on.")
+var serveHTTP = flag.Bool("serve-http", false, "Deprecated: use goin serve.")
@@ -3,6 +3,7 @@ module github.com/rubiojr/goin
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/RoaringBitmap/roaring v0.4.21 // indirect
 	github.com/Smerity/govarint v0.0.0-20150407073650-7265e41f48f1 // indirect
 	github.com/blevesearch/bleve v0.8.1
@@ -12,12 +13,15 @@ require (
 	github.com/couchbase/vellum v0.0.0-20190829182332-ef2e028c01fd // indirect
 	github.com/dhowden/tag v0.0.0-20170128231422-9edd38ca5d10
 	github.com/edsrzf/mmap-go v1.0.1-0.20190108065903-904c4ced31cd // indirect
-	github.com/etcd-io/bbolt v1.3.2 // indirect
+	github.com/etcd-io/bbolt v1.3.2
 	github.com/fatih/color v1.5.0
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/gdamore/tcell v1.4.0
 	github.com/golang/protobuf v0.0.0-20170512171634-fec3b39b059c // indirect
 	github.com/gorilla/mux v1.7.3
 	github.com/mattn/go-colorable v0.0.7 // indirect
 	github.com/mattn/go-isatty v0.0.2 // indirect
+	github.com/mattn/go-runewidth v0.0.7
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/smartystreets/goconvey v0.0.0-20190306220146-200a235640ff // indirect
 	github.com/steveyen/gtreap v0.0.0-20150807155958-0abe01ef9be2 // indirect
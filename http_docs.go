@@ -0,0 +1,170 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// serveDocument writes the stored fields of a document, including its Text,
+// as json.
+func (s *server) serveDocument(rw http.ResponseWriter, req *http.Request) {
+	name, id := indexNameLookup(req), docIDLookup(req)
+	si, ok := s.indexes[name]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("no such index '%s'", name), http.StatusNotFound)
+		return
+	}
+	doc, err := si.index.Document(id)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error reading document '%s': %v", id, err), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		http.Error(rw, fmt.Sprintf("no such document '%s'", id), http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(rw).Encode(struct {
+		ID     string         `json:"id"`
+		Index  string         `json:"index"`
+		Fields storedDocument `json:"fields"`
+	}{id, name, newStoredDocument(doc)})
+}
+
+// serveFile streams the file a document was indexed from. Only files of
+// documents in one of the served indexes that are beneath the roots of that
+// index are served, after resolving symlinks. Archive members and messages
+// of an mbox are served as the file containing them. ?download=1 asks
+// browsers to save the file instead of showing it.
+func (s *server) serveFile(rw http.ResponseWriter, req *http.Request) {
+	id := docIDLookup(req)
+	si, doc, err := s.findDocument(id)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error reading document '%s': %v", id, err), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		http.Error(rw, fmt.Sprintf("no such document '%s'", id), http.StatusNotFound)
+		return
+	}
+	file, ok := confinedPath(containerPath(id), si.roots)
+	if !ok {
+		Debugf("Refusing to serve %q outside of the roots of %q", id, si.name)
+		http.Error(rw, fmt.Sprintf("file of '%s' is not beneath the roots of index '%s'", id, si.name), http.StatusForbidden)
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		log.Printf("Error opening %q, %v\n", file, err)
+		http.Error(rw, fmt.Sprintf("unable to open '%s'", id), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.Error(rw, fmt.Sprintf("unable to open '%s'", id), http.StatusNotFound)
+		return
+	}
+
+	mt, _ := doc["MimeType"].(string)
+	if containerPath(id) != id || mt == "" {
+		mt, _ = detectMimeType(file)
+	}
+	if mt == "" {
+		mt = "application/octet-stream"
+	}
+	disposition := "inline"
+	if req.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+	h := rw.Header()
+	h.Set("Content-Type", mt)
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filepath.Base(file)}))
+	// Indexed html must not run scripts with the origin of the search page.
+	h.Set("Content-Security-Policy", "sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(rw, req, filepath.Base(file), fi.ModTime(), f)
+}
+
+// findDocument returns the first served index, in order of their names,
+// with a document with id along with the document.
+func (s *server) findDocument(id string) (*servedIndex, storedDocument, error) {
+	names := []string{}
+	for name := range s.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		si := s.indexes[name]
+		doc, err := si.index.Document(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if doc != nil {
+			return si, newStoredDocument(doc), nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// confinedPath resolves the symlinks in file and returns the result if it
+// is an absolute path beneath one of roots.
+func confinedPath(file string, roots []string) (string, bool) {
+	if !filepath.IsAbs(file) || filepath.Clean(file) != file {
+		return "", false
+	}
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", false
+	}
+	realRoots := []string{}
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			continue
+		}
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			realRoots = append(realRoots, r)
+		}
+	}
+	if len(realRoots) == 0 || !underRoots(real, realRoots) {
+		return "", false
+	}
+	return real, true
+}
+
+// indexedRoots returns the directories holding the files with ids, leaving
+// out the ones beneath another. It stands in for the roots of indexes
+// without any configured.
+func indexedRoots(ids []string) []string {
+	dirs := []string{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		file := containerPath(id)
+		if !filepath.IsAbs(file) {
+			continue
+		}
+		dir := filepath.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	roots := []string{}
+	for _, dir := range dirs {
+		if len(roots) == 0 || !underRoots(dir, roots) {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
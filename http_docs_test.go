@@ -0,0 +1,95 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfinedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The temporary directory itself may be behind a symlink.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	sibling := filepath.Join(dir, "root2")
+	for _, d := range []string{root, filepath.Join(root, "sub"), outside, sibling} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "sub", "doc.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := ioutil.WriteFile(f, []byte("text"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "escape"):     outside,
+		filepath.Join(root, "secret.txt"): filepath.Join(outside, "secret.txt"),
+		filepath.Join(root, "inner.txt"):  filepath.Join(root, "sub", "doc.txt"),
+		filepath.Join(dir, "rootlink"):    root,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc := filepath.Join(root, "sub", "doc.txt")
+	roots := []string{root}
+	cases := []struct {
+		name  string
+		file  string
+		roots []string
+		want  string
+	}{
+		{"file beneath root", doc, roots, doc},
+		{"root itself", root, roots, root},
+		{"outside roots", filepath.Join(outside, "secret.txt"), roots, ""},
+		{"dot dot", filepath.Join(root, "sub") + "/../../outside/secret.txt", roots, ""},
+		{"relative path", "root/sub/doc.txt", roots, ""},
+		{"empty roots", doc, nil, ""},
+		{"relative root", doc, []string{"root"}, ""},
+		{"missing file", filepath.Join(root, "missing.txt"), roots, ""},
+		{"symlinked directory escaping", filepath.Join(root, "escape", "secret.txt"), roots, ""},
+		{"symlinked file escaping", filepath.Join(root, "secret.txt"), roots, ""},
+		{"symlink inside roots", filepath.Join(root, "inner.txt"), roots, doc},
+		{"symlinked root", doc, []string{filepath.Join(dir, "rootlink")}, doc},
+		{"name sharing the root's prefix", sibling, roots, ""},
+	}
+	for _, c := range cases {
+		got, ok := confinedPath(c.file, c.roots)
+		if got != c.want || ok != (c.want != "") {
+			t.Errorf("%s: confinedPath(%q, %q) = %q, %v, want %q", c.name, c.file, c.roots, got, ok, c.want)
+		}
+	}
+}
+
+func TestIndexedRoots(t *testing.T) {
+	cases := []struct {
+		ids  []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"/a/x.txt", "/a/b/y.txt", "/a-b/z.txt"}, []string{"/a", "/a-b"}},
+		{[]string{"/a/b/y.txt", "/a/c/z.txt"}, []string{"/a/b", "/a/c"}},
+		{[]string{"/m/mail.mbox!/3", "/m/x/archive.zip!/inner/f.txt"}, []string{"/m"}},
+		{[]string{"relative.txt"}, []string{}},
+	}
+	for _, c := range cases {
+		if got := indexedRoots(c.ids); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("indexedRoots(%q) = %q, want %q", c.ids, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// maxJobErrors is how many file errors a job keeps. Later ones are only
+// counted.
+const maxJobErrors = 100
+
+// maxFinishedJobs is how many finished jobs are remembered.
+const maxFinishedJobs = 100
+
+// jobError is a file a job failed to index.
+type jobError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// job indexes paths of an index in the background. Its fields are guarded
+// by mu and it is reported as json.
+type job struct {
+	mu        sync.Mutex
+	ID        string     `json:"id"`
+	Index     string     `json:"index"`
+	Paths     []string   `json:"paths"`
+	Force     bool       `json:"force"`
+	Prune     bool       `json:"prune"`
+	State     string     `json:"state"`
+	Total     int        `json:"total"`
+	Processed int        `json:"processed"`
+	Skipped   int        `json:"skipped"`
+	Failed    int        `json:"failed"`
+	Pruned    int        `json:"pruned"`
+	Errors    []jobError `json:"errors"`
+	Error     string     `json:"error,omitempty"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	cancelled bool
+}
+
+func (j *job) update(fn func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn()
+}
+
+func (j *job) fail(file string, err error) {
+	j.update(func() {
+		j.Failed++
+		if len(j.Errors) < maxJobErrors {
+			j.Errors = append(j.Errors, jobError{file, err.Error()})
+		}
+	})
+}
+
+func (j *job) isCancelled() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.cancelled
+}
+
+func (j *job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	type report job
+	return json.Marshal((*report)(j))
+}
+
+// jobList holds the jobs of a server.
+type jobList struct {
+	mu      sync.Mutex
+	next    int
+	jobs    map[string]*job
+	order   []string
+	running sync.WaitGroup
+}
+
+func newJobList() *jobList {
+	return &jobList{jobs: map[string]*job{}}
+}
+
+// Add registers a new job forgetting the oldest finished jobs past
+// maxFinishedJobs.
+func (l *jobList) Add(j *job) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	j.ID = strconv.Itoa(l.next)
+	l.jobs[j.ID] = j
+	l.order = append(l.order, j.ID)
+	finished := 0
+	for i := len(l.order) - 1; i >= 0; i-- {
+		old := l.jobs[l.order[i]]
+		old.mu.Lock()
+		done := old.Finished != nil
+		old.mu.Unlock()
+		if !done {
+			continue
+		}
+		if finished++; finished > maxFinishedJobs {
+			delete(l.jobs, l.order[i])
+			l.order = append(l.order[:i], l.order[i+1:]...)
+		}
+	}
+}
+
+func (l *jobList) Get(id string) *job {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.jobs[id]
+}
+
+// All returns every job, oldest first.
+func (l *jobList) All() []*job {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	all := []*job{}
+	for _, id := range l.order {
+		all = append(all, l.jobs[id])
+	}
+	return all
+}
+
+// Stop cancels every job and waits for the running ones to finish the files
+// they are on.
+func (l *jobList) Stop() {
+	for _, j := range l.All() {
+		j.update(func() { j.cancelled = true })
+	}
+	l.running.Wait()
+}
+
+// jobProcessor counts the files a job processes, skips and fails to index.
+// Once the job is cancelled every remaining file is skipped.
+type jobProcessor struct {
+	FileProcessor
+	job *job
+}
+
+func (p *jobProcessor) ShouldProcess(file string) (bool, error) {
+	if p.job.isCancelled() {
+		return false, nil
+	}
+	ok, err := p.FileProcessor.ShouldProcess(file)
+	if err != nil {
+		p.job.fail(file, err)
+	} else if !ok {
+		p.job.update(func() { p.job.Skipped++ })
+	}
+	return ok, err
+}
+
+func (p *jobProcessor) Process(file string) error {
+	if err := p.FileProcessor.Process(file); err != nil {
+		p.job.fail(file, err)
+		return err
+	}
+	p.job.update(func() { p.job.Processed++ })
+	return nil
+}
+
+// indexRequest is the body of a request to index files. Without paths the
+// roots of the index are indexed. Prune removes the files beneath paths that
+// no longer exist afterwards.
+type indexRequest struct {
+	Paths []string `json:"paths"`
+	Force bool     `json:"force"`
+	Prune bool     `json:"prune"`
+}
+
+// startIndexJob starts a job indexing the files and directories in the
+// request, which have to be beneath the roots of the index unless the
+// server is local. Those paths are indexed with their symlinks resolved. It
+// replies with the job and its location.
+func (s *server) startIndexJob(rw http.ResponseWriter, req *http.Request) {
+	si, ok := s.writableIndex(rw, req)
+	if !ok {
+		return
+	}
+	var ir indexRequest
+	if err := json.NewDecoder(req.Body).Decode(&ir); err != nil && err != io.EOF {
+		http.Error(rw, fmt.Sprintf("error parsing request: %v", err), http.StatusBadRequest)
+		return
+	}
+	paths := ir.Paths
+	if len(paths) == 0 {
+		paths = append(paths, si.roots...)
+	}
+	if len(paths) == 0 {
+		http.Error(rw, fmt.Sprintf("index '%s' has no roots to index", si.name), http.StatusBadRequest)
+		return
+	}
+	for i, path := range paths {
+		path = filepath.Clean(path)
+		if s.local && filepath.IsAbs(path) {
+			paths[i] = path
+			continue
+		}
+		real, ok := confinedPath(path, si.roots)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("'%s' is not beneath the roots of index '%s'", path, si.name), http.StatusForbidden)
+			return
+		}
+		// A symlink swapped in after the check can't lead the job outside
+		// of the roots.
+		paths[i] = real
+	}
+
+	j := &job{Index: si.name, Paths: paths, Force: ir.Force, Prune: ir.Prune, State: jobQueued, Created: time.Now(), Errors: []jobError{}}
+	s.jobs.Add(j)
+	s.jobs.running.Add(1)
+	go func() {
+		defer s.jobs.running.Done()
+		s.runIndexJob(si, j)
+	}()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Location", "/api/jobs/"+j.ID)
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(j)
+}
+
+// runIndexJob indexes the paths of j once no other job is writing to si.
+func (s *server) runIndexJob(si *servedIndex, j *job) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if j.isCancelled() {
+		j.update(func() {
+			now := time.Now()
+			j.State, j.Finished = jobCancelled, &now
+		})
+		return
+	}
+
+	total := 0
+	for _, path := range j.Paths {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			walkDirectory(path, newIgnoreMatcherFor(path), nil, func(string) { total++ })
+		} else {
+			total++
+		}
+	}
+	j.update(func() {
+		now := time.Now()
+		j.State, j.Started, j.Total = jobRunning, &now, total
+	})
+	log.Printf("Starting job %s indexing %q into %q", j.ID, j.Paths, si.name)
+
+	p := &jobProcessor{NewProcessor(si.meta, si.writer, j.Force, *paranoid), j}
+	for _, path := range j.Paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			j.fail(path, err)
+			continue
+		}
+		if fi.IsDir() {
+			IndexDirectory(path, p)
+		} else {
+			IndexFile(path, p)
+		}
+	}
+	err := p.Flush()
+	if err == nil && j.Prune && !j.isCancelled() {
+		var pruned int
+		pruned, err = p.Prune(j.Paths)
+		if ferr := p.Flush(); err == nil {
+			err = ferr
+		}
+		j.update(func() { j.Pruned = pruned })
+	}
+
+	j.update(func() {
+		now := time.Now()
+		j.Finished = &now
+		switch {
+		case err != nil:
+			j.State, j.Error = jobFailed, err.Error()
+		case j.cancelled:
+			j.State = jobCancelled
+		default:
+			j.State = jobDone
+		}
+		log.Printf("Job %s %s: %d processed, %d skipped, %d failed", j.ID, j.State, j.Processed, j.Skipped, j.Failed)
+	})
+}
+
+// deleteDocument removes a document from an index along with the members
+// of an archive once no job is writing to the index.
+func (s *server) deleteDocument(rw http.ResponseWriter, req *http.Request) {
+	si, ok := s.writableIndex(rw, req)
+	if !ok {
+		return
+	}
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	id := docIDLookup(req)
+	doc, err := si.index.Document(id)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error reading document '%s': %v", id, err), http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		http.Error(rw, fmt.Sprintf("no such document '%s'", id), http.StatusNotFound)
+		return
+	}
+	p := NewProcessor(si.meta, si.writer, false, false)
+	if err := p.Remove(id); err == nil {
+		err = p.Flush()
+	}
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error deleting document '%s': %v", id, err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted %q from %q", id, si.name)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// writableIndex returns the index a request is for if it can be written to
+// and otherwise replies with an error.
+func (s *server) writableIndex(rw http.ResponseWriter, req *http.Request) (*servedIndex, bool) {
+	name := indexNameLookup(req)
+	si, ok := s.indexes[name]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("no such index '%s'", name), http.StatusNotFound)
+		return nil, false
+	}
+	if si.writer == nil {
+		http.Error(rw, fmt.Sprintf("index '%s' is served read-only", name), http.StatusConflict)
+		return nil, false
+	}
+	return si, true
+}
+
+// serveJob writes the progress of a job as json.
+func (s *server) serveJob(rw http.ResponseWriter, req *http.Request) {
+	id := docIDLookup(req)
+	j := s.jobs.Get(id)
+	if j == nil {
+		http.Error(rw, fmt.Sprintf("no such job '%s'", id), http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(rw).Encode(j)
+}
+
+// serveJobs writes every job the server remembers as json.
+func (s *server) serveJobs(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(rw).Encode(struct {
+		Jobs []*job `json:"jobs"`
+	}{s.jobs.All()})
+}
@@ -1,62 +1,374 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/blevesearch/bleve"
 	bleveHttp "github.com/blevesearch/bleve/http"
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout is how long the server waits for requests to finish when
+// it is stopped.
+const shutdownTimeout = 10 * time.Second
+
+// corsWrapper lets the web pages of the allowed origins call the API.
 type corsWrapper struct {
-	r *mux.Router
+	r       http.Handler
+	origins []string
 }
 
-var indexDir = filepath.Join(homeDir, ".goin")
+func (s *corsWrapper) allowed(origin string) bool {
+	for _, o := range s.origins {
+		if o == "*" || strings.TrimSuffix(o, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
 
+// muxVariableLookup returns the unescaped value of a route variable. Routes
+// match the escaped path so document ids can contain slashes.
 func muxVariableLookup(req *http.Request, name string) string {
-	return mux.Vars(req)[name]
+	v, err := url.PathUnescape(mux.Vars(req)[name])
+	if err != nil {
+		return ""
+	}
+	return v
+}
+
+func docIDLookup(req *http.Request) string {
+	return muxVariableLookup(req, "id")
 }
 
 func indexNameLookup(req *http.Request) string {
 	return muxVariableLookup(req, "indexName")
 }
 
-func startServer() {
-	router := mux.NewRouter()
+// server serves indexes over http under their names.
+type server struct {
+	router  *mux.Router
+	auth    *authenticator
+	indexes map[string]*servedIndex
+	// metas holds the metadata stores of the writable indexes by location
+	// as profiles can share one.
+	metas map[string]MetaStore
+	jobs  *jobList
+	// local servers only take requests from the user running them so the
+	// files they index don't have to be beneath the roots of the index.
+	local bool
+}
+
+// servedIndex is an index served by goin serve along with the roots its
+// files can be downloaded from and indexed.
+type servedIndex struct {
+	name     string
+	location string
+	roots    []string
+	index    bleve.Index
+	// metaLocation is the metadata store of the index. Indexes without one
+	// are served read-only.
+	metaLocation string
+	meta         MetaStore
+	writer       *bleveIndex
+	// mu makes the indexing jobs of the index run one at a time.
+	mu sync.Mutex
+}
+
+// servedIndexes returns the indexes to serve: the ones given with --index,
+// the one picked with --profile or --index_location or else the index of
+// every profile in the config file. Without a config file --index_location
+// is served named after its directory. The roots of the profile of an index
+// are the only places its files are served from and indexed. newServer falls
+// back to the directories of its files for indexes without roots. Indexes
+// given by location with --index have no metadata store.
+func servedIndexes() ([]*servedIndex, error) {
+	names := []string(*searchIndexes)
+	if len(names) == 0 {
+		switch {
+		case setFlags["index_location"]:
+			// Served below as no other index is named.
+		case *profile != "":
+			return []*servedIndex{{
+				name: *profile, location: *indexLocation, roots: profileRoots, metaLocation: *metaLocation,
+			}}, nil
+		default:
+			for name := range configProfiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+	}
+	seen := map[string]bool{}
+	served := []*servedIndex{}
+	for _, name := range names {
+		location, err := resolveIndex(name)
+		if err != nil {
+			if len(*searchIndexes) > 0 {
+				return nil, err
+			}
+			// Profiles that only search other indexes have no index of
+			// their own.
+			Debugf("Not serving profile %q, %v", name, err)
+			continue
+		}
+		if seen[location] {
+			log.Printf("Not serving %q, %q is already served", name, location)
+			continue
+		}
+		seen[location] = true
+		roots, err := profileStrings(name, "roots")
+		if err != nil {
+			return nil, err
+		}
+		si := &servedIndex{name: name, location: location, roots: roots}
+		if _, ok := configProfiles[name]; ok {
+			// Profiles without a meta_location use the default one like
+			// goin index does.
+			if si.metaLocation, err = profileSetting(name, "meta_location"); err != nil {
+				si.metaLocation = flag.Lookup("meta_location").DefValue
+			}
+		}
+		served = append(served, si)
+	}
+	if len(served) == 0 {
+		name := filepath.Base(*indexLocation)
+		return []*servedIndex{{
+			name: name, location: *indexLocation, roots: profileRoots, metaLocation: *metaLocation,
+		}}, nil
+	}
+	return served, nil
+}
+
+// newServer opens indexes and registers them under their names. Indexes
+// with a metadata store are opened for writing unless readOnly is set.
+// Requests need one of tokens unless there are none.
+func newServer(indexes []*servedIndex, tokens []*apiToken, readOnly bool) (*server, error) {
+	s := &server{
+		router:  mux.NewRouter(),
+		auth:    &authenticator{tokens: tokens},
+		indexes: map[string]*servedIndex{},
+		metas:   map[string]MetaStore{},
+		jobs:    newJobList(),
+	}
+	for _, si := range indexes {
+		if readOnly {
+			si.metaLocation = ""
+		}
+		if err := s.open(si); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if len(si.roots) == 0 {
+			ids, err := documentIDs(si.index)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			si.roots = indexedRoots(ids)
+			if len(si.roots) == 0 {
+				log.Printf("Index %q has no roots, set roots in its profile to serve and index its files", si.name)
+			} else {
+				log.Printf("Index %q has no roots, using the directories it indexed: %q", si.name, si.roots)
+			}
+		}
+		s.indexes[si.name] = si
+		bleveHttp.RegisterIndexName(si.name, si.index)
+	}
+
+	router := s.router
 	router.StrictSlash(true)
+	router.UseEncodedPath()
+
+	read := func(h http.Handler) http.Handler { return s.auth.require(scopeRead, h) }
+	admin := func(h http.Handler) http.Handler { return s.auth.require(scopeAdmin, s.guardAdmin(h)) }
+
+	router.Handle("/", read(http.HandlerFunc(serveSearchPage))).Methods("GET")
 
 	listIndexesHandler := bleveHttp.NewListIndexesHandler()
-	router.Handle("/api", listIndexesHandler).Methods("GET")
+	router.Handle("/api", read(listIndexesHandler)).Methods("GET")
 
 	docCountHandler := bleveHttp.NewDocCountHandler("")
 	docCountHandler.IndexNameLookup = indexNameLookup
-	router.Handle("/api/{indexName}/_count", docCountHandler).Methods("GET")
+	router.Handle("/api/{indexName}/_count", read(docCountHandler)).Methods("GET")
 
 	searchHandler := bleveHttp.NewSearchHandler("")
 	searchHandler.IndexNameLookup = indexNameLookup
-	router.Handle("/api/{indexName}/_search", searchHandler).Methods("POST")
-
-	http.Handle("/", &corsWrapper{router})
+	router.Handle("/api/{indexName}/_search", read(searchHandler)).Methods("POST")
 
-	log.Printf("opening indexes")
-	indexPath := indexDir + string(os.PathSeparator) + "index.bleve"
+	router.Handle("/api/{indexName}/doc/{id}", read(http.HandlerFunc(s.serveDocument))).Methods("GET")
+	router.Handle("/api/{indexName}/doc/{id}", admin(http.HandlerFunc(s.deleteDocument))).Methods("DELETE")
+	router.Handle("/api/{indexName}/_index", admin(http.HandlerFunc(s.startIndexJob))).Methods("POST")
+	router.Handle("/api/jobs", read(http.HandlerFunc(s.serveJobs))).Methods("GET")
+	router.Handle("/api/jobs/{id}", read(http.HandlerFunc(s.serveJob))).Methods("GET")
+	router.Handle("/files/{id}", read(http.HandlerFunc(s.serveFile))).Methods("GET", "HEAD")
+	return s, nil
+}
 
-	i, err := bleve.OpenUsing(indexPath, map[string]interface{}{
-		"read_only": true,
+// guardAdmin wraps h, a handler changing indexes. Servers without tokens
+// only allow it when they are the local daemon. Requests have to be json so
+// browsers preflight them and other origins can't send them unless allowed.
+func (s *server) guardAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(s.auth.tokens) == 0 && !s.local {
+			http.Error(rw, "changing indexes needs a token, add one with goin token add --scope admin", http.StatusForbidden)
+			return
+		}
+		if mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			http.Error(rw, "expected Content-Type: application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		h.ServeHTTP(rw, req)
 	})
+}
+
+// open opens the index of si, for writing along with its metadata store if
+// it has one. Indexes that can't be written, like ones another goin is
+// indexing or ones with an outdated schema, are served read-only.
+func (s *server) open(si *servedIndex) error {
+	log.Printf("Opening index %q at %q", si.name, si.location)
+	if si.metaLocation != "" {
+		err := s.openWritable(si)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Serving %q read-only, %v", si.name, err)
+		si.metaLocation = ""
+	}
+	if err := recoverIndex(si.location); err != nil {
+		return fmt.Errorf("Error recovering index %q: %v", si.name, err)
+	}
+	if _, err := os.Stat(si.location); err != nil {
+		return fmt.Errorf("Error opening index %q: %v", si.name, err)
+	}
+	index, err := openBleveIndex(si.location, true)
+	if err != nil {
+		return err
+	}
+	index.SetName(si.name)
+	si.index = index
+	return nil
+}
+
+// openWritable opens the metadata store of si before its index as that
+// fails fast when another process holds it.
+func (s *server) openWritable(si *servedIndex) error {
+	meta, ok := s.metas[si.metaLocation]
+	if !ok {
+		var err error
+		if meta, err = NewMetaStore(si.metaLocation); err != nil {
+			return err
+		}
+		s.metas[si.metaLocation] = meta
+	}
+	index, err := openBleveIndex(si.location, false)
+	if err != nil {
+		return err
+	}
+	index.SetName(si.name)
+	si.index = index
+	si.meta = meta
+	si.writer = &bleveIndex{index: index, batch: index.NewBatch()}
+	return nil
+}
+
+// ListenAndServe serves on addr until the process gets SIGINT or SIGTERM,
+// using TLS if certFile and keyFile are given and allowing cross origin
+// requests from origins. Without tokens only requests for the hosts
+// allowedHost accepts are served. The indexes are closed once the requests
+// in flight and the running indexing jobs are done.
+func (s *server) ListenAndServe(addr, certFile, keyFile string, origins []string) error {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Printf("error opening index %s: %v", indexPath, err)
+		s.Close()
+		return err
+	}
+	fmt.Printf("Serving %d indexes on %s\n", len(s.indexes), addr)
+	var h http.Handler = &corsWrapper{s.router, origins}
+	if len(s.auth.tokens) == 0 {
+		h = &hostChecker{h, addr}
+	}
+	return s.serve(l, h, certFile, keyFile)
+}
+
+// serve serves h on l until the process gets SIGINT or SIGTERM and then
+// closes the server.
+func (s *server) serve(l net.Listener, h http.Handler, certFile, keyFile string) error {
+	hs := &http.Server{Handler: h}
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Got %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- hs.Shutdown(ctx)
+	}()
+
+	var err error
+	if certFile != "" || keyFile != "" {
+		err = hs.ServeTLS(l, certFile, keyFile)
 	} else {
-		bleveHttp.RegisterIndexName("index.bleve", i)
+		err = hs.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		s.Close()
+		return err
+	}
+	err = <-stopped
+	if cerr := s.Close(); err == nil {
+		err = cerr
 	}
+	return err
+}
+
+// Close stops the indexing jobs, then unregisters and closes every index
+// and metadata store.
+func (s *server) Close() error {
+	s.jobs.Stop()
+	var err error
+	for name, si := range s.indexes {
+		bleveHttp.UnregisterIndexByName(name)
+		var cerr error
+		if si.writer != nil {
+			cerr = si.writer.Close()
+		} else {
+			cerr = si.index.Close()
+		}
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.indexes, name)
+	}
+	for location, meta := range s.metas {
+		if cerr := meta.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.metas, location)
+	}
+	return err
 }
 
 func (s *corsWrapper) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if origin := req.Header.Get("Origin"); origin != "" {
+	rw.Header().Add("Vary", "Origin")
+	if origin := req.Header.Get("Origin"); origin != "" && s.allowed(origin) {
 		rw.Header().Set("Access-Control-Allow-Origin", origin)
 		rw.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		rw.Header().Set("Access-Control-Allow-Headers",
@@ -71,3 +383,34 @@ func (s *corsWrapper) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// Continue to process request
 	s.r.ServeHTTP(rw, req)
 }
+
+// hostChecker refuses requests for hosts allowedHost rejects. Servers
+// without tokens use it so web pages can't reach them by pointing a DNS
+// name of their own at the address goin listens on.
+type hostChecker struct {
+	h      http.Handler
+	listen string
+}
+
+func (c *hostChecker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !allowedHost(req.Host, c.listen) {
+		http.Error(rw, fmt.Sprintf("host '%s' is not allowed without tokens, add one with goin token add", req.Host), http.StatusForbidden)
+		return
+	}
+	c.h.ServeHTTP(rw, req)
+}
+
+// allowedHost returns true if host, the Host header of a request, is an IP
+// address, localhost or the host name of the listen address.
+func allowedHost(host, listen string) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.TrimSuffix(strings.Trim(name, "[]"), ".")
+	if strings.EqualFold(name, "localhost") || net.ParseIP(name) != nil {
+		return true
+	}
+	listenHost, _, err := net.SplitHostPort(listen)
+	return err == nil && listenHost != "" && strings.EqualFold(name, listenHost)
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowedHost(t *testing.T) {
+	cases := []struct {
+		host, listen string
+		want         bool
+	}{
+		{"localhost:8080", "localhost:8080", true},
+		{"LOCALHOST", "localhost:8080", true},
+		{"127.0.0.1:8080", "localhost:8080", true},
+		{"[::1]:8080", "localhost:8080", true},
+		{"192.168.1.5:8080", ":8080", true},
+		{"search.lan:8080", "search.lan:8080", true},
+		{"search.lan.", "search.lan:8080", true},
+		{"evil.example.com:8080", "localhost:8080", false},
+		{"evil.example.com", ":8080", false},
+		{"", "localhost:8080", false},
+	}
+	for _, c := range cases {
+		if got := allowedHost(c.host, c.listen); got != c.want {
+			t.Errorf("allowedHost(%q, %q) = %v, want %v", c.host, c.listen, got, c.want)
+		}
+	}
+}
+
+func TestGuardAdmin(t *testing.T) {
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	tokens := []*apiToken{{name: "admin", scopes: []string{scopeAdmin}, hash: hashToken("a")}}
+	cases := []struct {
+		name        string
+		tokens      []*apiToken
+		local       bool
+		contentType string
+		want        int
+	}{
+		{"no tokens", nil, false, "application/json", http.StatusForbidden},
+		{"no tokens on the daemon", nil, true, "application/json", http.StatusOK},
+		{"tokens", tokens, false, "application/json; charset=utf-8", http.StatusOK},
+		{"plain text", tokens, false, "text/plain", http.StatusUnsupportedMediaType},
+		{"form", tokens, false, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"no content type", nil, true, "", http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		s := &server{auth: &authenticator{tokens: c.tokens}, local: c.local}
+		req := httptest.NewRequest("POST", "/api/docs/_index", strings.NewReader("{}"))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		rw := httptest.NewRecorder()
+		s.guardAdmin(ok).ServeHTTP(rw, req)
+		if rw.Code != c.want {
+			t.Errorf("%s: got status %d, want %d", c.name, rw.Code, c.want)
+		}
+	}
+}
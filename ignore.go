@@ -0,0 +1,244 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignoreFileName is the name of the gitignore syntax files that exclude
+// paths from indexing. They apply to the directory they are in and all of
+// its subdirectories.
+const ignoreFileName = ".goinignore"
+
+// ignoreRule is a single compiled gitignore pattern.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnorePattern compiles a gitignore pattern. ok is false for blank
+// lines and comments.
+func parseIgnorePattern(line string) (rule ignoreRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	// Patterns without a slash match at any depth, everything else is
+	// relative to the directory the pattern came from.
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	line = strings.TrimPrefix(line, "/")
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		Debugf("Ignoring invalid pattern %q: %v", line, err)
+		return rule, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// globToRegexp translates a gitignore glob into a regular expression.
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			re.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+// match reports whether rel, a slash separated path relative to the
+// directory the rule came from, matches the rule.
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(rel)
+}
+
+func compileIgnorePatterns(patterns []string) []ignoreRule {
+	rules := []ignoreRule{}
+	for _, pattern := range patterns {
+		if rule, ok := parseIgnorePattern(pattern); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func readIgnoreFile(file string) []ignoreRule {
+	f, err := os.Open(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Debugf("Unable to read ignore file %q: %v", file, err)
+		}
+		return nil
+	}
+	defer f.Close()
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return compileIgnorePatterns(patterns)
+}
+
+// ignoreMatcher decides which paths under a root directory get skipped. It
+// combines the ignore files found in each directory with include and exclude
+// patterns that apply relative to the root.
+type ignoreMatcher struct {
+	root      string
+	gitignore bool
+	includes  []ignoreRule
+	excludes  []ignoreRule
+
+	mu    sync.Mutex
+	rules map[string][]ignoreRule
+}
+
+func newIgnoreMatcher(root string, includes, excludes []string, gitignore bool) *ignoreMatcher {
+	return &ignoreMatcher{
+		root:      filepath.Clean(root),
+		gitignore: gitignore,
+		includes:  compileIgnorePatterns(includes),
+		excludes:  compileIgnorePatterns(excludes),
+		rules:     map[string][]ignoreRule{},
+	}
+}
+
+// rulesFor returns the rules from the ignore files in dir loading them on
+// first use.
+func (m *ignoreMatcher) rulesFor(dir string) []ignoreRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+	var rules []ignoreRule
+	if m.gitignore {
+		rules = append(rules, readIgnoreFile(filepath.Join(dir, ".gitignore"))...)
+	}
+	rules = append(rules, readIgnoreFile(filepath.Join(dir, ignoreFileName))...)
+	m.rules[dir] = rules
+	return rules
+}
+
+// Forget drops the cached rules for dir so they get reloaded.
+func (m *ignoreMatcher) Forget(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rules, dir)
+}
+
+// Contains reports whether path is the matcher's root or beneath it.
+func (m *ignoreMatcher) Contains(path string) bool {
+	return underRoots(path, []string{m.root})
+}
+
+func relSlash(base, path string) string {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Ignored reports whether path should be skipped. Ignore files closer to
+// path take precedence and within a file the last matching pattern wins.
+// Parent directories are expected to have been checked already.
+func (m *ignoreMatcher) Ignored(path string, isDir bool) bool {
+	if path == m.root || !m.Contains(path) {
+		return false
+	}
+	rel := relSlash(m.root, path)
+	for _, rule := range m.excludes {
+		if rule.match(rel, isDir) {
+			Debugf("Skipping %q: excluded by --exclude", path)
+			return true
+		}
+	}
+	if !isDir && len(m.includes) > 0 {
+		included := false
+		for _, rule := range m.includes {
+			if rule.match(rel, isDir) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			Debugf("Skipping %q: not matched by --include", path)
+			return true
+		}
+	}
+
+	ignored := false
+	dir := m.root
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if i > 0 {
+			dir = filepath.Join(dir, parts[i-1])
+		}
+		for _, rule := range m.rulesFor(dir) {
+			if rule.match(strings.Join(parts[i:], "/"), isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	if ignored {
+		Debugf("Skipping %q: matched an ignore file", path)
+	}
+	return ignored
+}
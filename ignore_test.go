@@ -0,0 +1,112 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreRuleMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "debug.log", false, true},
+		{"*.log", "a/b/debug.log", false, true},
+		{"*.log", "debug.log.txt", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"docs/*.md", "docs/a.md", false, true},
+		{"docs/*.md", "docs/sub/a.md", false, false},
+		{"docs/**/*.md", "docs/sub/deep/a.md", false, true},
+		{"docs/**/*.md", "docs/a.md", false, true},
+		{"tmp/", "tmp", true, true},
+		{"tmp/", "tmp", false, false},
+		{"cache/**", "cache/a/b", false, true},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file10.txt", false, false},
+		{"[abc].txt", "b.txt", false, true},
+		{"[!abc].txt", "b.txt", false, false},
+		{"[!abc].txt", "d.txt", false, true},
+		{`\#notes`, "#notes", false, true},
+		{"a+b.txt", "a+b.txt", false, true},
+		{"a+b.txt", "aab.txt", false, false},
+	}
+	for _, c := range cases {
+		rule, ok := parseIgnorePattern(c.pattern)
+		if !ok {
+			t.Errorf("parseIgnorePattern(%q) failed", c.pattern)
+			continue
+		}
+		if got := rule.match(c.rel, c.isDir); got != c.want {
+			t.Errorf("%q matching %q (dir %v) = %v, want %v", c.pattern, c.rel, c.isDir, got, c.want)
+		}
+	}
+	for _, line := range []string{"", "  ", "# comment", "/", "!"} {
+		if _, ok := parseIgnorePattern(line); ok {
+			t.Errorf("parseIgnorePattern(%q) returned a rule", line)
+		}
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "goin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		ignoreFileName:                       "*.tmp\n!keep.tmp\nbuild/\n",
+		filepath.Join("sub", ignoreFileName): "keep.tmp\n!*.bak\n",
+		".gitignore":                         "*.bak\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		rel       string
+		isDir     bool
+		gitignore bool
+		includes  []string
+		excludes  []string
+		want      bool
+	}{
+		{"a.txt", false, false, nil, nil, false},
+		{"a.tmp", false, false, nil, nil, true},
+		{"keep.tmp", false, false, nil, nil, false},
+		{"sub/keep.tmp", false, false, nil, nil, true},
+		{"build", true, false, nil, nil, true},
+		{"build", false, false, nil, nil, false},
+		{"a.bak", false, false, nil, nil, false},
+		{"a.bak", false, true, nil, nil, true},
+		{"sub/a.bak", false, true, nil, nil, false},
+		{"a.txt", false, false, []string{"*.md"}, nil, true},
+		{"a.md", false, false, []string{"*.md"}, nil, false},
+		{"sub", true, false, []string{"*.md"}, nil, false},
+		{"sub", true, false, []string{"*.md"}, []string{"sub/"}, true},
+		{"sub/a.md", false, false, []string{"*.md"}, []string{"a.*"}, true},
+	}
+	for _, c := range cases {
+		m := newIgnoreMatcher(root, c.includes, c.excludes, c.gitignore)
+		if got := m.Ignored(filepath.Join(root, filepath.FromSlash(c.rel)), c.isDir); got != c.want {
+			t.Errorf("Ignored(%q) with gitignore %v, includes %q, excludes %q = %v, want %v",
+				c.rel, c.gitignore, c.includes, c.excludes, got, c.want)
+		}
+	}
+
+	m := newIgnoreMatcher(root, nil, nil, false)
+	if m.Ignored(root, true) || m.Ignored(filepath.Dir(root), true) {
+		t.Errorf("the root and paths outside of it are never ignored")
+	}
+}
@@ -7,11 +7,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"mime"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // IndexFile indexes a single file using the provided FileProcessor
@@ -34,23 +33,103 @@ func IndexFile(file string, p FileProcessor) {
 	return
 }
 
-// IndexFile indexes all the files in a directory recursively using
-// the provided FileProcessor. It skips the directories it uses for storage.
-func IndexDirectory(dir string, p FileProcessor) {
-	log.Printf("Processing directory: %q", dir)
+// skipDirectory returns true for hidden directories, except Maildir++
+// folders, and the directories goin uses for storage.
+func skipDirectory(path string) bool {
+	return (strings.HasPrefix(filepath.Base(path), ".") && !isMaildirFolder(path)) ||
+		path == *indexLocation || path == *hashLocation
+}
+
+// newIgnoreMatcherFor returns an ignoreMatcher for root using the ignore
+// options from the command line.
+func newIgnoreMatcherFor(root string) *ignoreMatcher {
+	return newIgnoreMatcher(root, *includePatterns, *excludePatterns, *useGitignore)
+}
+
+// walkDirectory calls fileFn for every file in a directory recursively
+// skipping anything m ignores. If dirFn is not nil it is called for every
+// directory visited.
+func walkDirectory(dir string, m *ignoreMatcher, dirFn, fileFn func(string)) {
 	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Error walking %q, %v\n", path, err)
+			return nil
+		}
 		if info.IsDir() {
-			if strings.HasPrefix(info.Name(), ".") ||
-				path == *indexLocation || path == *hashLocation {
+			if path != dir && (skipDirectory(path) || m.Ignored(path, true)) {
 				return filepath.SkipDir
 			}
+			if dirFn != nil {
+				dirFn(path)
+			}
+			return nil
+		}
+		if m.Ignored(path, false) {
 			return nil
 		}
-		IndexFile(path, p)
+		fileFn(path)
 		return nil
 	})
 }
 
+// indexPool indexes files handed to it on a fixed number of workers.
+type indexPool struct {
+	files chan string
+	wg    sync.WaitGroup
+}
+
+func newIndexPool(p FileProcessor, workers int) *indexPool {
+	if workers < 1 {
+		workers = 1
+	}
+	pool := &indexPool{files: make(chan string)}
+	pool.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer pool.wg.Done()
+			for file := range pool.files {
+				IndexFile(file, p)
+			}
+		}()
+	}
+	return pool
+}
+
+// Add queues a file for indexing. It blocks until a worker is free.
+func (pool *indexPool) Add(file string) {
+	pool.files <- file
+}
+
+// Wait blocks until every queued file has been indexed. The pool can't be
+// used afterwards.
+func (pool *indexPool) Wait() {
+	close(pool.files)
+	pool.wg.Wait()
+}
+
+// IndexFile indexes all the files in a directory recursively using
+// the provided FileProcessor. It skips the directories it uses for storage.
+func IndexDirectory(dir string, p FileProcessor) {
+	log.Printf("Processing directory: %q", dir)
+	pool := newIndexPool(p, *workers)
+	walkDirectory(dir, newIgnoreMatcherFor(dir), nil, pool.Add)
+	pool.Wait()
+}
+
+// PruneIndex removes files under roots that no longer exist from the index
+// using the provided FileProcessor.
+func PruneIndex(roots []string, p FileProcessor) {
+	log.Printf("Pruning missing files")
+	removed, err := p.Prune(roots)
+	if err != nil {
+		log.Printf("Error pruning index, %v\n", err)
+	}
+	if err := p.Flush(); err != nil {
+		log.Print(err)
+	}
+	log.Printf("Pruned %d files", removed)
+}
+
 func formatFragment(frag string) string {
 	content := fmt.Sprintf("%s", frag)
 	lines := strings.Split(content, "\n")
@@ -61,101 +140,40 @@ func formatFragment(frag string) string {
 	return rv
 }
 
-func usage() string {
-	return fmt.Sprintln("") +
-		fmt.Sprintln("Indexing: \n\tgoindexer [options] --index <locations to index>") +
-		fmt.Sprintln("Querying: \n\tgoindexer [options] --query <search query>") +
-		fmt.Sprintln("") +
-		fmt.Sprintln("The locations to index can be a list of directories or files.") +
-		fmt.Sprintln("") +
-		fmt.Sprintln("The search query is in the syntax documented at: https://github.com/blevesearch/bleve/wiki/Query%20String%20Query.") +
-		fmt.Sprintln("")
-}
-
 func main() {
-	flag.Parse()
-
-	// Write annoying tesseract stderr to a file
-	// This means everything logged to stderr goes to that file unfortunately.
-	// Setting debug_file for tesseract doesn't seem to work for everything.
-	if !*isDebug {
-		os.Stderr.Close()
-		stderr, err := os.Create("/tmp/goin.err")
-		if err != nil {
-			panic(err)
-		}
-		os.Stderr = stderr
-		defer stderr.Close()
+	flag.Usage = func() {
+		fmt.Println(usage())
 	}
-
+	flag.Parse()
+	markSetFlags(flag.CommandLine)
 	if *help {
 		fmt.Println(usage())
-		flag.PrintDefaults()
 		os.Exit(0)
 	}
 
-	if *serveHTTP {
-		startServer()
-		log.Fatal(http.ListenAndServe(":8080", nil))
-	}
-
-	if !(*isQuery) && !(*isIndex) {
-		fmt.Println("One of --query or --index must be passed")
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
-
-	for k, v := range mimeTypeMappings {
-		log.Printf("Adding mime-type mapping for extension %q=%q", k, v)
-		mime.AddExtensionType(k, v)
-	}
-
-	index, err := NewIndex(*indexLocation)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer index.Close()
-
-	if *isQuery {
-		result, err := index.Query(flag.Args())
-		if err != nil {
-			log.Printf("Error: %q", err)
-			os.Exit(1)
+	var err error
+	if cmd, name := legacyCommand(); cmd != nil {
+		fmt.Fprintf(os.Stderr, "Warning: --%s is deprecated, use goin %s instead\n", name, cmd.name)
+		err = runCommand(cmd, flag.Args())
+	} else if flag.NArg() > 1 && flag.Arg(0) == "help" && lookupCommand(flag.Arg(1)) != nil {
+		fs := lookupCommand(flag.Arg(1)).flagSet()
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+	} else if cmd := lookupCommand(flag.Arg(0)); cmd != nil {
+		err = cmd.Run(flag.Args()[1:])
+	} else {
+		if flag.NArg() > 0 && flag.Arg(0) != "help" {
+			fmt.Printf("Unknown command %q\n\n", flag.Arg(0))
 		}
-		for i, match := range result.Hits {
-			fmt.Println("")
-			fmt.Printf("%d. %q (%f)\n", i+1, match.ID, match.Score)
-			for field, fragments := range match.Fragments {
-				fmt.Printf("%s: ", field)
-				for _, frag := range fragments {
-					fmt.Println(formatFragment(frag))
-				}
-				for fieldName, fieldValue := range match.Fields {
-					if _, ok := match.Fragments[fieldName]; !ok {
-						fmt.Printf("%s:\n", fieldName)
-						fmt.Println(formatFragment(fmt.Sprint(fieldValue)))
-					}
-				}
-			}
-		}
-		// TODO(jwall): handle facet outputs?
-		fmt.Printf("\nTotal results: %d Retrieved %d to %d in %s.", result.Total, result.Request.From+1, result.Request.From+len(result.Hits), result.Took)
-		return
-	} else if *isIndex {
-		p := NewProcessor(*hashLocation, index, *force)
-		for _, file := range flag.Args() {
-			fi, err := os.Stat(file)
-			if os.IsNotExist(err) {
-				continue
-			}
-			if err != nil {
-				log.Printf("Error Stat(ing) file %q", err)
-			}
-			if fi.IsDir() {
-				IndexDirectory(file, p)
-			} else {
-				IndexFile(file, p)
-			}
+		fmt.Println(usage())
+		if flag.Arg(0) != "help" {
+			os.Exit(1)
 		}
 	}
+	if err != nil {
+		// Errors logged to stderr end up in /tmp/goin.err so print them
+		// to stdout.
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
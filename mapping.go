@@ -0,0 +1,161 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/registry"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// dirField holds the directories a document is in. A term query for a
+// directory on it matches everything beneath that directory.
+const dirField = "dir"
+
+const pathHierarchy = "path_hierarchy"
+
+// pathHierarchyTokenizer turns a path into one token for each of its parent
+// directories, so /a/b/c.txt becomes /a and /a/b. Archive members also get
+// a token for the archive they are in.
+type pathHierarchyTokenizer struct{}
+
+func (pathHierarchyTokenizer) Tokenize(input []byte) analysis.TokenStream {
+	stream := analysis.TokenStream{}
+	add := func(end int) {
+		stream = append(stream, &analysis.Token{
+			Term:     input[:end],
+			Position: len(stream) + 1,
+			Start:    0,
+			End:      end,
+			Type:     analysis.AlphaNumeric,
+		})
+	}
+	for i := 1; i < len(input); i++ {
+		if input[i] != '/' {
+			continue
+		}
+		if strings.HasSuffix(string(input[:i+1]), archiveMember) {
+			add(i - 1)
+		} else {
+			add(i)
+		}
+	}
+	return stream
+}
+
+func init() {
+	registry.RegisterTokenizer(pathHierarchy, func(config map[string]interface{}, cache *registry.Cache) (analysis.Tokenizer, error) {
+		return pathHierarchyTokenizer{}, nil
+	})
+	registry.RegisterAnalyzer(pathHierarchy, func(config map[string]interface{}, cache *registry.Cache) (*analysis.Analyzer, error) {
+		tokenizer, err := cache.TokenizerNamed(pathHierarchy)
+		if err != nil {
+			return nil, err
+		}
+		return &analysis.Analyzer{Tokenizer: tokenizer}, nil
+	})
+}
+
+// dirQuery matches the documents beneath dir.
+func dirQuery(dir string) query.Query {
+	q := bleve.NewTermQuery(absPath(dir))
+	q.SetField(dirField)
+	return q
+}
+
+// splitDirTerms separates dir:/some/path terms from the rest of a query
+// string. The query string syntax would read the path as a regular
+// expression.
+func splitDirTerms(terms []string) ([]string, []query.Query) {
+	rest, dirs := []string{}, []query.Query{}
+	for _, term := range terms {
+		trimmed := strings.TrimPrefix(term, "+")
+		if strings.HasPrefix(trimmed, dirField+":") {
+			dirs = append(dirs, dirQuery(strings.Trim(trimmed[len(dirField)+1:], `"`)))
+			continue
+		}
+		rest = append(rest, term)
+	}
+	return rest, dirs
+}
+
+func textField(analyzer string) *mapping.FieldMapping {
+	fm := bleve.NewTextFieldMapping()
+	fm.Analyzer = analyzer
+	return fm
+}
+
+// keywordField is matched exactly and can be used for facets and sorting.
+func keywordField() *mapping.FieldMapping {
+	return textField(keyword.Name)
+}
+
+func fields(dm *mapping.DocumentMapping, fm *mapping.FieldMapping, names ...string) {
+	for _, name := range names {
+		dm.AddFieldMappingsAt(name, fm)
+	}
+}
+
+// buildFileDataMapping maps the fields of FileData. textAnalyzer is only
+// used for the Text field.
+func buildFileDataMapping(textAnalyzer string) *mapping.DocumentMapping {
+	dm := bleve.NewDocumentMapping()
+	dir := textField(pathHierarchy)
+	dir.Name = dirField
+	dir.Store = false
+	dir.IncludeInAll = false
+	dir.IncludeTermVectors = false
+	dm.AddFieldMappingsAt("FullPath", keywordField(), dir)
+	fields(dm, keywordField(), "FileName", "MimeType", "MimeDetection")
+	fields(dm, bleve.NewDateTimeFieldMapping(), "IndexTime", "ModTime")
+	fields(dm, bleve.NewNumericFieldMapping(), "Size")
+	fields(dm, textField(textAnalyzer), "Text")
+	return dm
+}
+
+func buildAudioDataMapping() *mapping.DocumentMapping {
+	dm := buildFileDataMapping(en.AnalyzerName)
+	fields(dm, keywordField(), "Artist", "Album", "Genre")
+	fields(dm, textField(standard.Name), "Title")
+	fields(dm, bleve.NewNumericFieldMapping(), "Year", "Track")
+	return dm
+}
+
+func buildOfficeDataMapping() *mapping.DocumentMapping {
+	dm := buildFileDataMapping(en.AnalyzerName)
+	fields(dm, keywordField(), "Author")
+	fields(dm, textField(standard.Name), "Title")
+	fields(dm, bleve.NewDateTimeFieldMapping(), "Created", "Modified")
+	return dm
+}
+
+func buildEmailDataMapping() *mapping.DocumentMapping {
+	dm := buildFileDataMapping(en.AnalyzerName)
+	fields(dm, keywordField(), "MessageID")
+	fields(dm, textField(standard.Name), "From", "To", "Cc", "Subject")
+	fields(dm, bleve.NewDateTimeFieldMapping(), "Date")
+	return dm
+}
+
+// buildIndexMapping returns the mapping for new indexes. Documents are
+// mapped by their Type, which is their mime type for plain FileData. The
+// default analyzer is used for searches without a field so it has to match
+// the one used for Text.
+func buildIndexMapping() *mapping.IndexMappingImpl {
+	im := bleve.NewIndexMapping()
+	im.DefaultAnalyzer = en.AnalyzerName
+	im.DefaultMapping = buildFileDataMapping(en.AnalyzerName)
+	im.AddDocumentMapping(htmlMimeType, buildFileDataMapping(htmlMimeType))
+	im.AddDocumentMapping("audio", buildAudioDataMapping())
+	im.AddDocumentMapping("office", buildOfficeDataMapping())
+	im.AddDocumentMapping("email", buildEmailDataMapping())
+	return im
+}
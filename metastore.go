@@ -0,0 +1,185 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// FileMeta is what goin remembers about a file it has indexed.
+type FileMeta struct {
+	// sha256 of the file contents.
+	Hash []byte `json:"Hash"`
+	// Size of the file when it was hashed.
+	Size int64 `json:"Size"`
+	// Modification time of the file when it was hashed.
+	ModTime time.Time `json:"ModTime"`
+	// MimeType the file was indexed as.
+	MimeType string `json:"MimeType"`
+	// Translator that turned the file into text.
+	Translator string `json:"Translator"`
+	// Time of last index.
+	IndexTime time.Time `json:"IndexTime"`
+	// Ids of the documents indexed from inside an archive.
+	Members []string `json:"Members,omitempty"`
+}
+
+// MetaStore persists FileMeta keyed by the absolute path of a file.
+type MetaStore interface {
+	// Get returns nil, nil if nothing is stored for file.
+	Get(file string) (*FileMeta, error)
+	Put(file string, meta *FileMeta) error
+	// PutAll stores every entry in files at once.
+	PutAll(files map[string]*FileMeta) error
+	Delete(file string) error
+	ForEach(fn func(file string, meta *FileMeta) error) error
+	Close() error
+}
+
+var filesBucket = []byte("files")
+
+type boltMetaStore struct {
+	db *bolt.DB
+}
+
+// metaKey turns file into the key it is stored under.
+func metaKey(file string) []byte {
+	return []byte(absPath(file))
+}
+
+func (s *boltMetaStore) Get(file string) (*FileMeta, error) {
+	var meta *FileMeta
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bs := tx.Bucket(filesBucket).Get(metaKey(file))
+		if bs == nil {
+			return nil
+		}
+		meta = &FileMeta{}
+		return json.Unmarshal(bs, meta)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error reading metadata for %q: %v", file, err)
+	}
+	return meta, nil
+}
+
+func (s *boltMetaStore) Put(file string, meta *FileMeta) error {
+	return s.PutAll(map[string]*FileMeta{file: meta})
+}
+
+func (s *boltMetaStore) PutAll(files map[string]*FileMeta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket)
+		for file, meta := range files {
+			bs, err := json.Marshal(meta)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(metaKey(file), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltMetaStore) Delete(file string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Delete(metaKey(file))
+	})
+}
+
+// ForEach calls fn for every stored file. fn must not modify the store.
+func (s *boltMetaStore) ForEach(fn func(file string, meta *FileMeta) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			meta := &FileMeta{}
+			if err := json.Unmarshal(v, meta); err != nil {
+				return fmt.Errorf("Error reading metadata for %q: %v", k, err)
+			}
+			return fn(string(k), meta)
+		})
+	})
+}
+
+func (s *boltMetaStore) Close() error {
+	return s.db.Close()
+}
+
+// NewMetaStore opens the metadata store at location creating it if needed.
+func NewMetaStore(location string) (MetaStore, error) {
+	if err := os.MkdirAll(filepath.Dir(location), os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+	Debugf("Opening metadata store %q", location)
+	db, err := bolt.Open(location, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening metadata store %q: %v", location, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(filesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltMetaStore{db}, nil
+}
+
+// hashFileName is the name a file's hash was stored under in the old
+// one-file-per-document hash directory.
+func hashFileName(file string) string {
+	dirPath := filepath.Dir(file)
+	prefix := strings.Replace(dirPath, string(filepath.Separator), "_", -1)
+	return prefix + filepath.Base(file)
+}
+
+// MigrateHashDir moves the hashes from the old hash directory into store.
+// The flattened hash file names can't be turned back into paths so the
+// documents in index are used to find them, skipping ones with relative
+// paths. Once done the directory is renamed so the migration only ever
+// happens once.
+func MigrateHashDir(dir string, store MetaStore, index Index) error {
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil
+	}
+	log.Printf("Migrating hashes from %q", dir)
+	paths, err := index.Paths()
+	if err != nil {
+		return err
+	}
+	migrated := map[string]*FileMeta{}
+	for _, file := range paths {
+		// Relative ids were relative to wherever goin ran back then.
+		if !filepath.IsAbs(file) {
+			log.Printf("Not migrating the hash of %q, its path is relative", file)
+			continue
+		}
+		hash, err := ioutil.ReadFile(filepath.Join(dir, hashFileName(file)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Size and ModTime are left empty since we don't know them for
+		// the hashed contents. That forces a hash check next time.
+		migrated[file] = &FileMeta{Hash: hash}
+	}
+	if err := store.PutAll(migrated); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d hashes", len(migrated))
+	return os.Rename(dir, dir+".migrated")
+}
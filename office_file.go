@@ -0,0 +1,352 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	docxMimeType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	xlsxMimeType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	pptxMimeType = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	odtMimeType  = "application/vnd.oasis.opendocument.text"
+	odsMimeType  = "application/vnd.oasis.opendocument.spreadsheet"
+	odpMimeType  = "application/vnd.oasis.opendocument.presentation"
+)
+
+// officeTranslators maps the office document mime types to the
+// FileTranslators that extract their text.
+var officeTranslators = map[string]FileTranslator{
+	docxMimeType: getDocxText,
+	xlsxMimeType: getXlsxText,
+	pptxMimeType: getPptxText,
+	odtMimeType:  getOdfText,
+	odsMimeType:  getOdfText,
+	odpMimeType:  getOdfText,
+}
+
+func init() {
+	mime.AddExtensionType(".docx", docxMimeType)
+	mime.AddExtensionType(".xlsx", xlsxMimeType)
+	mime.AddExtensionType(".pptx", pptxMimeType)
+	mime.AddExtensionType(".odt", odtMimeType)
+	mime.AddExtensionType(".ods", odsMimeType)
+	mime.AddExtensionType(".odp", odpMimeType)
+}
+
+func isOfficeMimeType(mt string) bool {
+	_, ok := officeTranslators[mt]
+	return ok
+}
+
+// OfficeData is a word processor, spreadsheet or presentation document.
+type OfficeData struct {
+	*FileData `json:""`
+	Title     string    `json:"Title"`
+	Author    string    `json:"Author"`
+	Created   time.Time `json:"Created"`
+	Modified  time.Time `json:"Modified"`
+}
+
+func (data *OfficeData) Type() string {
+	return "office"
+}
+
+func (data *OfficeData) Path() string {
+	return data.FullPath
+}
+
+// Analyse reads the document properties from the OOXML docProps/core.xml or
+// OpenDocument meta.xml part of file.
+func (data *OfficeData) Analyse(file string) {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		Debugf("Unable to read properties of %q: %v", data.FullPath, err)
+		return
+	}
+	defer z.Close()
+	props := map[string]string{}
+	for _, name := range []string{"docProps/core.xml", "meta.xml"} {
+		if err := readZipXML(&z.Reader, name, func(d *xml.Decoder) error {
+			return xmlFields(d, props)
+		}); err == nil {
+			break
+		}
+	}
+	data.Title = props["title"]
+	data.Author = props["creator"]
+	if data.Author == "" {
+		data.Author = props["initial-creator"]
+	}
+	data.Created = parseOfficeTime(props["created"])
+	if data.Created.IsZero() {
+		data.Created = parseOfficeTime(props["creation-date"])
+	}
+	data.Modified = parseOfficeTime(props["modified"])
+	if data.Modified.IsZero() {
+		data.Modified = parseOfficeTime(props["date"])
+	}
+}
+
+func parseOfficeTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// xmlFields stores the text of every leaf element in d under its local name.
+func xmlFields(d *xml.Decoder, fields map[string]string) error {
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == name && text.Len() > 0 {
+				fields[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+// readZipXML calls fn with a decoder for the named member of z.
+func readZipXML(z *zip.Reader, name string, fn func(*xml.Decoder) error) error {
+	for _, f := range z.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return fn(xml.NewDecoder(r))
+	}
+	return fmt.Errorf("missing %q", name)
+}
+
+// zipMembers returns the names of the members of z matching the glob
+// pattern ordered by the number in their name, so slide10 comes after
+// slide9.
+func zipMembers(z *zip.Reader, pattern string) []string {
+	names := []string{}
+	for _, f := range z.File {
+		if ok, _ := path.Match(pattern, f.Name); ok {
+			names = append(names, f.Name)
+		}
+	}
+	number := func(name string) int {
+		digits := strings.TrimFunc(path.Base(name), func(r rune) bool { return r < '0' || r > '9' })
+		n, _ := strconv.Atoi(digits)
+		return n
+	}
+	sort.Slice(names, func(i, j int) bool { return number(names[i]) < number(names[j]) })
+	return names
+}
+
+// xmlText collects the character data found inside any of the textElems.
+// Elements in breaks add their separator to the text when they end.
+func xmlText(d *xml.Decoder, textElems map[string]bool, breaks map[string]string, out *strings.Builder) error {
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if textElems[t.Name.Local] {
+				depth++
+			}
+		case xml.CharData:
+			if depth > 0 {
+				out.Write(t)
+			}
+		case xml.EndElement:
+			if textElems[t.Name.Local] {
+				depth--
+			}
+			if sep, ok := breaks[t.Name.Local]; ok {
+				out.WriteString(sep)
+			}
+		}
+	}
+}
+
+// extractZipText runs xmlText over every member of file matching one of the
+// patterns in order.
+func extractZipText(file string, textElems map[string]bool, breaks map[string]string, patterns ...string) (string, error) {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+	var out strings.Builder
+	for _, pattern := range patterns {
+		for _, name := range zipMembers(&z.Reader, pattern) {
+			err := readZipXML(&z.Reader, name, func(d *xml.Decoder) error {
+				return xmlText(d, textElems, breaks, &out)
+			})
+			if err != nil {
+				return "", fmt.Errorf("reading %q from %q: %v", name, file, err)
+			}
+			out.WriteString("\n")
+		}
+	}
+	return out.String(), nil
+}
+
+var ooxmlText = map[string]bool{"t": true}
+var ooxmlBreaks = map[string]string{"p": "\n", "tab": "\t", "br": "\n", "cr": "\n"}
+
+func getDocxText(file string) (string, error) {
+	return extractZipText(file, ooxmlText, ooxmlBreaks,
+		"word/document.xml", "word/header*.xml", "word/footer*.xml",
+		"word/footnotes.xml", "word/endnotes.xml")
+}
+
+// getPptxText returns the text of every slide followed by the speaker notes.
+func getPptxText(file string) (string, error) {
+	return extractZipText(file, ooxmlText, ooxmlBreaks,
+		"ppt/slides/slide*.xml", "ppt/notesSlides/notesSlide*.xml")
+}
+
+func getXlsxText(file string) (string, error) {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+
+	shared := []string{}
+	// Workbooks without any strings don't have a sharedStrings part.
+	readZipXML(&z.Reader, "xl/sharedStrings.xml", func(d *xml.Decoder) error {
+		var text strings.Builder
+		for {
+			tok, err := d.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "si" {
+					text.Reset()
+				} else if t.Name.Local == "t" {
+					var s string
+					if err := d.DecodeElement(&s, &t); err != nil {
+						return err
+					}
+					text.WriteString(s)
+				}
+			case xml.EndElement:
+				if t.Name.Local == "si" {
+					shared = append(shared, text.String())
+				}
+			}
+		}
+	})
+
+	var out strings.Builder
+	for _, name := range zipMembers(&z.Reader, "xl/worksheets/sheet*.xml") {
+		err := readZipXML(&z.Reader, name, func(d *xml.Decoder) error {
+			return xlsxSheetText(d, shared, &out)
+		})
+		if err != nil {
+			return "", fmt.Errorf("reading %q from %q: %v", name, file, err)
+		}
+		out.WriteString("\n")
+	}
+	return out.String(), nil
+}
+
+// xlsxCell is a cell in a worksheet. Strings are either an index into the
+// shared strings table or stored inline.
+type xlsxCell struct {
+	Type   string `xml:"t,attr"`
+	Value  string `xml:"v"`
+	Inline string `xml:"is>t"`
+}
+
+// xlsxSheetText writes the cell values of a worksheet separated by tabs with
+// one row per line.
+func xlsxSheetText(d *xml.Decoder, shared []string, out *strings.Builder) error {
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "c" {
+				continue
+			}
+			var cell xlsxCell
+			if err := d.DecodeElement(&cell, &t); err != nil {
+				return err
+			}
+			value := cell.Value
+			switch cell.Type {
+			case "s":
+				if i, err := strconv.Atoi(cell.Value); err == nil && i >= 0 && i < len(shared) {
+					value = shared[i]
+				}
+			case "inlineStr":
+				value = cell.Inline
+			}
+			if value != "" {
+				out.WriteString(value)
+				out.WriteString("\t")
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				out.WriteString("\n")
+			}
+		}
+	}
+}
+
+var odfText = map[string]bool{"p": true, "h": true}
+var odfBreaks = map[string]string{
+	"p": "\n", "h": "\n", "s": " ", "tab": "\t", "line-break": "\n", "table-cell": "\t",
+}
+
+// getOdfText handles OpenDocument text, spreadsheets and presentations. They
+// all keep their body, including any speaker notes, in content.xml.
+func getOdfText(file string) (string, error) {
+	return extractZipText(file, odfText, odfBreaks, "content.xml")
+}
@@ -0,0 +1,242 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/registry"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/highlight"
+	htmlFormatter "github.com/blevesearch/bleve/search/highlight/format/html"
+	simpleFragmenter "github.com/blevesearch/bleve/search/highlight/fragmenter/simple"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/ansi"
+	simpleHighlighter "github.com/blevesearch/bleve/search/highlight/highlighter/simple"
+	"github.com/fatih/color"
+)
+
+// plainHighlighter picks the same fragments as the other highlighters
+// without marking the matched terms.
+const plainHighlighter = "plain"
+
+func init() {
+	registry.RegisterHighlighter(plainHighlighter, func(config map[string]interface{}, cache *registry.Cache) (highlight.Highlighter, error) {
+		fragmenter, err := cache.FragmenterNamed(simpleFragmenter.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error building fragmenter: %v", err)
+		}
+		formatter := htmlFormatter.NewFragmentFormatter("", "")
+		return simpleHighlighter.NewHighlighter(fragmenter, formatter, simpleHighlighter.DefaultSeparator), nil
+	})
+}
+
+// resultWriters holds a function writing query results for each --format.
+var resultWriters = map[string]func(io.Writer, *bleve.SearchResult) error{
+	"text":   writeText,
+	"json":   writeJSON,
+	"ndjson": writeNDJSON,
+	"csv":    writeCSV,
+	"paths":  writePaths,
+}
+
+// resultHighlighter returns the highlighter to use for query results or ""
+// for none. ANSI colors are only used for text written to a terminal.
+func resultHighlighter() string {
+	if *outputFormat == "paths" {
+		return ""
+	}
+	if !*useHighlight {
+		return plainHighlighter
+	}
+	if *highlightStyle != "" {
+		return *highlightStyle
+	}
+	if *outputFormat == "text" && !color.NoColor {
+		return ansi.Name
+	}
+	return plainHighlighter
+}
+
+// WriteResults writes result to w in the given format.
+func WriteResults(w io.Writer, format string, result *bleve.SearchResult) error {
+	write, ok := resultWriters[format]
+	if !ok {
+		return fmt.Errorf("unknown output format %q", format)
+	}
+	return write(w, result)
+}
+
+// queryResult is the stable form of a bleve.SearchResult used by the
+// machine readable formats.
+type queryResult struct {
+	Total uint64 `json:"total"`
+	From  int    `json:"from"`
+	// Took is the duration of the search in nanoseconds.
+	Took time.Duration `json:"took"`
+	Hits []queryHit    `json:"hits"`
+	// Facets holds the counts for every --facet by name.
+	Facets search.FacetResults `json:"facets,omitempty"`
+}
+
+type queryHit struct {
+	ID string `json:"id"`
+	// Index is the name of the index the hit came from when searching
+	// several.
+	Index     string                 `json:"index,omitempty"`
+	Score     float64                `json:"score"`
+	Fields    map[string]interface{} `json:"fields"`
+	Fragments map[string][]string    `json:"fragments"`
+}
+
+func newQueryHit(match *search.DocumentMatch) queryHit {
+	hit := queryHit{
+		ID:        match.ID,
+		Index:     match.Index,
+		Score:     match.Score,
+		Fields:    match.Fields,
+		Fragments: match.Fragments,
+	}
+	if hit.Fields == nil {
+		hit.Fields = map[string]interface{}{}
+	}
+	if hit.Fragments == nil {
+		hit.Fragments = map[string][]string{}
+	}
+	return hit
+}
+
+func newQueryResult(result *bleve.SearchResult) queryResult {
+	qr := queryResult{
+		Total:  result.Total,
+		Took:   result.Took,
+		Hits:   make([]queryHit, 0, len(result.Hits)),
+		Facets: result.Facets,
+	}
+	if result.Request != nil {
+		qr.From = result.Request.From
+	}
+	for _, match := range result.Hits {
+		qr.Hits = append(qr.Hits, newQueryHit(match))
+	}
+	return qr
+}
+
+func writeText(w io.Writer, result *bleve.SearchResult) error {
+	for i, match := range result.Hits {
+		fmt.Fprintln(w, "")
+		if match.Index != "" {
+			fmt.Fprintf(w, "%d. %q (%f) in %s\n", i+1, match.ID, match.Score, match.Index)
+		} else {
+			fmt.Fprintf(w, "%d. %q (%f)\n", i+1, match.ID, match.Score)
+		}
+		for field, fragments := range match.Fragments {
+			fmt.Fprintf(w, "%s: ", field)
+			for _, frag := range fragments {
+				fmt.Fprintln(w, formatFragment(frag))
+			}
+		}
+		for fieldName, fieldValue := range match.Fields {
+			if _, ok := match.Fragments[fieldName]; !ok {
+				fmt.Fprintf(w, "%s:\n", fieldName)
+				fmt.Fprintln(w, formatFragment(fmt.Sprint(fieldValue)))
+			}
+		}
+	}
+	writeFacetsText(w, result.Facets)
+	_, err := fmt.Fprintf(w, "\nTotal results: %d Retrieved %d to %d in %s.\n", result.Total, result.Request.From+1, result.Request.From+len(result.Hits), result.Took)
+	return err
+}
+
+func writeJSON(w io.Writer, result *bleve.SearchResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newQueryResult(result))
+}
+
+// writeNDJSON writes one hit per line.
+func writeNDJSON(w io.Writer, result *bleve.SearchResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, match := range result.Hits {
+		if err := enc.Encode(newQueryHit(match)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCSV writes a row per hit with a column for every stored field and
+// one for the fragments of every highlighted field. Multiple fragments of a
+// field are joined with " … ". An index column follows the score when the
+// hits come from several indexes.
+func writeCSV(w io.Writer, result *bleve.SearchResult) error {
+	fieldSet, fragmentSet := map[string]bool{}, map[string]bool{}
+	withIndex := false
+	for _, match := range result.Hits {
+		withIndex = withIndex || match.Index != ""
+		for name := range match.Fields {
+			fieldSet[name] = true
+		}
+		for name := range match.Fragments {
+			fragmentSet[name] = true
+		}
+	}
+	fields, fragments := sortedKeys(fieldSet), sortedKeys(fragmentSet)
+
+	cw := csv.NewWriter(w)
+	header := []string{"id", "score"}
+	if withIndex {
+		header = append(header, "index")
+	}
+	header = append(header, fields...)
+	for _, name := range fragments {
+		header = append(header, "fragments."+name)
+	}
+	cw.Write(header)
+	for _, match := range result.Hits {
+		row := []string{match.ID, fmt.Sprint(match.Score)}
+		if withIndex {
+			row = append(row, match.Index)
+		}
+		for _, name := range fields {
+			value := ""
+			if v, ok := match.Fields[name]; ok {
+				value = fmt.Sprint(v)
+			}
+			row = append(row, value)
+		}
+		for _, name := range fragments {
+			row = append(row, strings.Join(match.Fragments[name], " … "))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writePaths(w io.Writer, result *bleve.SearchResult) error {
+	for _, match := range result.Hits {
+		if _, err := fmt.Fprintln(w, match.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
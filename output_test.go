@@ -0,0 +1,85 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestIndex returns an index in a temporary directory holding a single
+// text file. cleanup closes and removes it.
+func newTestIndex(t *testing.T) (index Index, cleanup func()) {
+	dir, err := ioutil.TempDir("", "goin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err = NewIndex(filepath.Join(dir, "index.bleve"), false)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	var doc IFile = &FileData{
+		FullPath: "/docs/note.txt",
+		FileName: "note.txt",
+		MimeType: "text/plain",
+		Text:     "hello world",
+		Size:     11,
+		ModTime:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := index.Put(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return index, func() {
+		index.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJSONHitFields(t *testing.T) {
+	index, cleanup := newTestIndex(t)
+	defer cleanup()
+	defer func(format string) { *outputFormat = format }(*outputFormat)
+	*outputFormat = "json"
+
+	result, err := index.Query([]string{"hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := WriteResults(&b, "json", result); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Hits []struct {
+			Fields map[string]interface{} `json:"fields"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+		t.Fatalf("invalid json %q: %v", b.String(), err)
+	}
+	if len(out.Hits) != 1 {
+		t.Fatalf("got %d hits, want 1", len(out.Hits))
+	}
+	fields := out.Hits[0].Fields
+	for _, name := range []string{"MimeType", "Size", "ModTime"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("hit has no %s field: %v", name, fields)
+		}
+	}
+	if fields["MimeType"] != "text/plain" || fields["Size"] != 11.0 {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	if _, ok := fields["Text"]; ok {
+		t.Errorf("hit has the Text field")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// underRoots returns true if file is one of roots or lives beneath one of
+// them. An empty list of roots matches everything.
+func underRoots(file string, roots []string) bool {
+	if len(roots) == 0 {
+		return true
+	}
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if file == root || strings.HasPrefix(file, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune removes every indexed file under roots that no longer exists on disk
+// along with its metadata. It returns the number of documents removed from
+// the index.
+func (p *processor) Prune(roots []string) (int, error) {
+	absRoots := make([]string, len(roots))
+	for i, root := range roots {
+		absRoots[i] = absPath(root)
+	}
+	roots = absRoots
+	paths, err := p.Paths()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range paths {
+		if !underRoots(file, roots) || exists(containerPath(file)) {
+			continue
+		}
+		Debugf("Pruning missing file %q", file)
+		if err := p.Remove(file); err != nil {
+			log.Printf("Error pruning file %q, %v\n", file, err)
+			continue
+		}
+		removed++
+	}
+
+	// Drop metadata for missing files that never made it into the index.
+	stale := []string{}
+	err = p.meta.ForEach(func(file string, meta *FileMeta) error {
+		if underRoots(file, roots) && !exists(file) {
+			stale = append(stale, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	for _, file := range stale {
+		Debugf("Dropping metadata for missing file %q", file)
+		if err := p.meta.Delete(file); err != nil {
+			log.Printf("Error dropping metadata for %q, %v\n", file, err)
+		}
+	}
+	return removed, nil
+}
+
+// RemoveAll removes every indexed file that is one of roots or lives beneath
+// them along with its metadata whether it still exists or not. It returns the
+// number of documents removed from the index.
+func (p *processor) RemoveAll(roots []string) (int, error) {
+	absRoots := make([]string, len(roots))
+	for i, root := range roots {
+		absRoots[i] = absPath(root)
+	}
+	roots = absRoots
+	paths, err := p.Paths()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range paths {
+		if !underRoots(file, roots) && !underRoots(containerPath(file), roots) {
+			continue
+		}
+		if err := p.Remove(file); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	files := []string{}
+	err = p.meta.ForEach(func(file string, meta *FileMeta) error {
+		if underRoots(file, roots) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	for _, file := range files {
+		if err := p.meta.Delete(file); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func exists(file string) bool {
+	_, err := os.Lstat(file)
+	return !os.IsNotExist(err)
+}
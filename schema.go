@@ -0,0 +1,260 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+)
+
+// indexSchemaVersion needs to be bumped whenever buildIndexMapping or the
+// documents it maps change in a way that requires existing indexes to be
+// rebuilt. Indexes without a recorded version are version 1.
+const indexSchemaVersion = 3
+
+var schemaVersionKey = []byte("goin_schema_version")
+
+// schemaVersion returns the schema version recorded in index.
+func schemaVersion(index bleve.Index) (int, error) {
+	v, err := index.GetInternal(schemaVersionKey)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return 1, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+func setSchemaVersion(index bleve.Index) error {
+	return index.SetInternal(schemaVersionKey, []byte(strconv.Itoa(indexSchemaVersion)))
+}
+
+// checkSchema returns an error if index was built with a different schema.
+func checkSchema(index bleve.Index, location string) error {
+	v, err := schemaVersion(index)
+	if err != nil {
+		return fmt.Errorf("Error reading schema version of %q: %v", location, err)
+	}
+	if v != indexSchemaVersion {
+		return fmt.Errorf("index %q has schema version %d but goin uses version %d, run goin migrate to rebuild it", location, v, indexSchemaVersion)
+	}
+	return nil
+}
+
+// storedDocument is a document rebuilt from the stored fields of an index.
+type storedDocument map[string]interface{}
+
+// newStoredDocument collects the stored fields of doc. Fields of the
+// embedded FileData used to be stored under a FileData. prefix.
+func newStoredDocument(doc *document.Document) storedDocument {
+	sd := storedDocument{}
+	for _, f := range doc.Fields {
+		var value interface{}
+		switch f := f.(type) {
+		case *document.TextField:
+			value = string(f.Value())
+		case *document.NumericField:
+			value, _ = f.Number()
+		case *document.DateTimeField:
+			value, _ = f.DateTime()
+		case *document.BooleanField:
+			value, _ = f.Boolean()
+		default:
+			continue
+		}
+		name := strings.TrimPrefix(f.Name(), "FileData.")
+		switch existing := sd[name].(type) {
+		case nil:
+			sd[name] = value
+		case []interface{}:
+			sd[name] = append(existing, value)
+		default:
+			sd[name] = []interface{}{existing, value}
+		}
+	}
+	if _, ok := sd["FullPath"]; !ok {
+		sd["FullPath"] = doc.ID
+	}
+	return sd
+}
+
+// Type matches the Type of the document newDocument creates for the mime
+// type.
+func (sd storedDocument) Type() string {
+	mt, _ := sd["MimeType"].(string)
+	switch {
+	case mt == "audio/mp3" || mt == "audio/mp4a-latm":
+		return "audio"
+	case isOfficeMimeType(mt):
+		return "office"
+	case mt == emailMimeType:
+		return "email"
+	}
+	return mt
+}
+
+func (sd storedDocument) Path() string {
+	return sd["FullPath"].(string)
+}
+
+// copyDocuments writes every document stored in from to to.
+func copyDocuments(from bleve.Index, to Index) (int, error) {
+	ids, err := documentIDs(from)
+	if err != nil {
+		return 0, err
+	}
+	for n, id := range ids {
+		doc, err := from.Document(id)
+		if err != nil {
+			return n, err
+		}
+		if doc == nil {
+			continue
+		}
+		sd := newStoredDocument(doc)
+		// Documents from before ModTime was indexed get the modification
+		// time of their file.
+		if _, ok := sd["ModTime"]; !ok {
+			if fi, err := os.Stat(containerPath(id)); err == nil {
+				sd["ModTime"] = fi.ModTime()
+			}
+		}
+		var ifile IFile = sd
+		if err := to.Put(&ifile); err != nil {
+			return n, err
+		}
+		if (n+1)%*batchSize == 0 {
+			if err := to.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return len(ids), to.Flush()
+}
+
+// reindexFiles runs the translators again for every file in meta writing
+// the documents to index.
+func reindexFiles(meta MetaStore, index Index) (int, error) {
+	files := []string{}
+	err := meta.ForEach(func(file string, _ *FileMeta) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	p := NewProcessor(meta, index, true, *paranoid)
+	pool := newIndexPool(p, *workers)
+	for _, file := range files {
+		pool.Add(file)
+	}
+	pool.Wait()
+	return len(files), p.Flush()
+}
+
+// MigrateIndex rebuilds the index at location with the current schema. The
+// new index is built next to the old one, from its stored documents or by
+// reindexing every known file if reindex is true, and only replaces it once
+// it is complete.
+func MigrateIndex(location string, meta MetaStore, reindex bool) error {
+	if err := recoverIndex(location); err != nil {
+		return err
+	}
+	old, err := bleve.OpenUsing(location, map[string]interface{}{"read_only": true})
+	if err != nil {
+		return fmt.Errorf("Error opening index %q: %v", location, err)
+	}
+	v, err := schemaVersion(old)
+	if err != nil {
+		old.Close()
+		return err
+	}
+	log.Printf("Migrating %q from schema version %d to %d", location, v, indexSchemaVersion)
+
+	tmp := location + migratingSuffix
+	if err := os.RemoveAll(tmp); err != nil {
+		old.Close()
+		return err
+	}
+	index, err := NewIndex(tmp, false)
+	if err != nil {
+		old.Close()
+		return err
+	}
+	var n int
+	if reindex {
+		old.Close()
+		n, err = reindexFiles(meta, index)
+	} else {
+		n, err = copyDocuments(old, index)
+		old.Close()
+	}
+	if err != nil {
+		index.Close()
+		os.RemoveAll(tmp)
+		return fmt.Errorf("Error migrating %q: %v", location, err)
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d documents", n)
+	return swapIndex(location, tmp)
+}
+
+// Suffixes of the directories next to an index while it gets migrated.
+const (
+	migratingSuffix = ".migrating"
+	backupSuffix    = ".old"
+)
+
+// swapIndex replaces the index at location with the one at replacement.
+// The old index is kept at location.old until the new one is in place so
+// recoverIndex can finish or undo an interrupted swap.
+func swapIndex(location, replacement string) error {
+	if err := recoverIndex(location); err != nil {
+		return err
+	}
+	backup := location + backupSuffix
+	if err := os.Rename(location, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(replacement, location); err != nil {
+		if rerr := os.Rename(backup, location); rerr != nil {
+			log.Printf("Error restoring %q from %q, %v\n", location, backup, rerr)
+		}
+		return err
+	}
+	return os.RemoveAll(backup)
+}
+
+// recoverIndex cleans up after a migration of the index at location that
+// was interrupted while swapping in the new index. Without an index at
+// location the new one is complete and put in place if it is still there,
+// otherwise the old one is restored.
+func recoverIndex(location string) error {
+	backup := location + backupSuffix
+	if !exists(backup) {
+		return nil
+	}
+	if exists(location) {
+		log.Printf("Removing %q left over from migrating %q", backup, location)
+		return os.RemoveAll(backup)
+	}
+	if replacement := location + migratingSuffix; exists(replacement) {
+		log.Printf("Finishing the interrupted migration of %q", location)
+		if err := os.Rename(replacement, location); err != nil {
+			return err
+		}
+		return os.RemoveAll(backup)
+	}
+	log.Printf("Restoring %q from %q", location, backup)
+	return os.Rename(backup, location)
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverIndex(t *testing.T) {
+	cases := []struct {
+		name string
+		// The index directories present before recovering, named by the
+		// version they hold.
+		current, old, migrating string
+		want                    string
+		leftOver                bool
+	}{
+		{"nothing to recover", "v1", "", "", "v1", false},
+		{"interrupted build", "v1", "", "v2", "v1", true},
+		{"backup not removed", "v2", "v1", "", "v2", false},
+		{"swap interrupted", "", "v1", "v2", "v2", false},
+		{"replacement lost", "", "v1", "", "v1", false},
+		{"no index", "", "", "", "", false},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "goin-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		location := filepath.Join(dir, "index.bleve")
+		for suffix, version := range map[string]string{"": c.current, backupSuffix: c.old, migratingSuffix: c.migrating} {
+			if version == "" {
+				continue
+			}
+			if err := os.Mkdir(location+suffix, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(location+suffix, "version"), []byte(version), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := recoverIndex(location); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		got, _ := ioutil.ReadFile(filepath.Join(location, "version"))
+		if string(got) != c.want {
+			t.Errorf("%s: got index %q, want %q", c.name, got, c.want)
+		}
+		if exists(location + backupSuffix) {
+			t.Errorf("%s: %s left behind", c.name, backupSuffix)
+		}
+		if exists(location+migratingSuffix) != c.leftOver {
+			t.Errorf("%s: %s exists %v, want %v", c.name, migratingSuffix, !c.leftOver, c.leftOver)
+		}
+	}
+}
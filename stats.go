@@ -0,0 +1,111 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/blevesearch/bleve"
+)
+
+type typeCount struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// indexStats is what goin stats reports about an index.
+type indexStats struct {
+	Location      string `json:"location"`
+	SchemaVersion int    `json:"schema_version"`
+	Documents     uint64 `json:"documents"`
+	// Files is the number of files in the metadata store. Archive members
+	// and messages of an mbox are documents but not files.
+	Files    int   `json:"files"`
+	DiskSize int64 `json:"disk_size"`
+	// Types holds the --facet_size most common mime types.
+	Types []typeCount `json:"types"`
+	Other int         `json:"other_types"`
+}
+
+// IndexStats counts the documents in index by the facetSize most common
+// mime types along with the files in meta, if there is one, and the size of
+// the index at location.
+func IndexStats(location string, index Index, meta MetaStore, facetSize int) (*indexStats, error) {
+	stats := &indexStats{Location: location, Types: []typeCount{}}
+	var err error
+	if stats.SchemaVersion, err = index.SchemaVersion(); err != nil {
+		return nil, err
+	}
+	request := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 0, 0, false)
+	request.AddFacet("MimeType", bleve.NewFacetRequest("MimeType", facetSize))
+	result, err := index.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	stats.Documents = result.Total
+	if f := result.Facets["MimeType"]; f != nil {
+		for _, term := range f.Terms {
+			stats.Types = append(stats.Types, typeCount{term.Term, term.Count})
+		}
+		stats.Other = f.Other + f.Missing
+	}
+	if meta != nil {
+		err = meta.ForEach(func(string, *FileMeta) error {
+			stats.Files++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A live index removes segment files while they are counted.
+	err = filepath.Walk(location, func(_ string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err == nil && !info.IsDir() {
+			stats.DiskSize += info.Size()
+		}
+		return err
+	})
+	return stats, err
+}
+
+// WriteText prints the stats for people.
+func (s *indexStats) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Index:          %s\n", s.Location)
+	fmt.Fprintf(w, "Schema version: %d\n", s.SchemaVersion)
+	fmt.Fprintf(w, "Documents:      %d\n", s.Documents)
+	fmt.Fprintf(w, "Files:          %d\n", s.Files)
+	fmt.Fprintf(w, "Size on disk:   %s\n", formatSize(s.DiskSize))
+	if len(s.Types) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Types:")
+	for _, t := range s.Types {
+		fmt.Fprintf(w, "  %-40s %d\n", t.Type, t.Count)
+	}
+	if s.Other > 0 {
+		fmt.Fprintf(w, "  %-40s %d\n", "other", s.Other)
+	}
+}
+
+// formatSize turns a number of bytes into a size like 1.5M.
+func formatSize(n int64) string {
+	units := "kMGT"
+	if n < 1<<10 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size := float64(n)
+	for i := range units {
+		size /= 1 << 10
+		if size < 1<<10 || i == len(units)-1 {
+			return fmt.Sprintf("%.1f%c", size, units[i])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,453 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
+	"github.com/gdamore/tcell"
+	runewidth "github.com/mattn/go-runewidth"
+)
+
+// searchDelay is how long the TUI waits for more typing before searching.
+const searchDelay = 150 * time.Millisecond
+
+const (
+	markStart = "<mark>"
+	markEnd   = "</mark>"
+)
+
+var (
+	tuiNormal    = tcell.StyleDefault
+	tuiBold      = tcell.StyleDefault.Bold(true)
+	tuiMatch     = tcell.StyleDefault.Foreground(tcell.ColorYellow).Bold(true)
+	tuiSelected  = tcell.StyleDefault.Reverse(true)
+	tuiStatus    = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	tuiErrorText = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
+// searchDone is posted to the event loop when a search finishes.
+type searchDone struct {
+	seq    int
+	result *bleve.SearchResult
+	err    error
+}
+
+// tui is the interactive search started by goin tui.
+type tui struct {
+	screen tcell.Screen
+	index  Index
+
+	input []rune
+	// seq identifies the latest search so older results can be ignored.
+	seq   int
+	timer *time.Timer
+
+	from     int
+	result   *bleve.SearchResult
+	err      error
+	selected int
+	// top is the first hit shown in the result list.
+	top int
+
+	previewID    string
+	previewWidth int
+	preview      []string
+	previewTop   int
+	message      string
+}
+
+// RunTUI runs the interactive search on index until the user quits.
+func RunTUI(index Index) error {
+	t := &tui{index: index}
+	if err := t.initScreen(); err != nil {
+		return err
+	}
+	// The screen is already finished if it can't be set up again after $EDITOR.
+	restore := true
+	defer func() {
+		if restore {
+			t.screen.Fini()
+		}
+	}()
+	t.search()
+	for {
+		t.draw()
+		switch ev := t.screen.PollEvent().(type) {
+		case *tcell.EventResize:
+			t.screen.Sync()
+		case *tcell.EventInterrupt:
+			if done, ok := ev.Data().(searchDone); ok && done.seq == t.seq {
+				t.result, t.err = done.result, done.err
+				t.selected, t.top, t.previewID = 0, 0, ""
+			}
+		case *tcell.EventKey:
+			quit, err := t.handleKey(ev)
+			if err != nil {
+				restore = false
+				return err
+			}
+			if quit {
+				return nil
+			}
+		}
+	}
+}
+
+func (t *tui) initScreen() error {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return err
+	}
+	if err := screen.Init(); err != nil {
+		return err
+	}
+	t.screen = screen
+	return nil
+}
+
+// handleKey reacts to a key press and returns true if the TUI should exit or
+// an error if it can't go on.
+func (t *tui) handleKey(ev *tcell.EventKey) (bool, error) {
+	t.message = ""
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return true, nil
+	case tcell.KeyRune:
+		t.input = append(t.input, ev.Rune())
+		t.from = 0
+		t.searchLater()
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(t.input) > 0 {
+			t.input = t.input[:len(t.input)-1]
+			t.from = 0
+			t.searchLater()
+		}
+	case tcell.KeyCtrlU:
+		t.input = nil
+		t.from = 0
+		t.searchLater()
+	case tcell.KeyUp:
+		if t.selected > 0 {
+			t.selected--
+		}
+	case tcell.KeyDown:
+		if t.result != nil && t.selected < len(t.result.Hits)-1 {
+			t.selected++
+		}
+	case tcell.KeyPgDn:
+		t.previewTop += t.previewHeight()
+	case tcell.KeyPgUp:
+		t.previewTop -= t.previewHeight()
+	case tcell.KeyCtrlN:
+		if t.result != nil && uint64(t.from+len(t.result.Hits)) < t.result.Total {
+			t.from += *limit
+			t.search()
+		}
+	case tcell.KeyCtrlP:
+		if t.from > 0 {
+			t.from -= *limit
+			if t.from < 0 {
+				t.from = 0
+			}
+			t.search()
+		}
+	case tcell.KeyEnter:
+		if id := t.selectedID(); id != "" {
+			t.open(containerPath(id))
+		}
+	case tcell.KeyCtrlE:
+		if id := t.selectedID(); id != "" {
+			return false, t.edit(containerPath(id))
+		}
+	}
+	return false, nil
+}
+
+// searchLater searches once the user stops typing for searchDelay.
+func (t *tui) searchLater() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.seq++
+	seq, q, from := t.seq, string(t.input), t.from
+	t.timer = time.AfterFunc(searchDelay, func() { t.run(seq, q, from) })
+}
+
+// search starts a search for the current input right away.
+func (t *tui) search() {
+	t.seq++
+	go t.run(t.seq, string(t.input), t.from)
+}
+
+// run searches for q starting at hit from and posts the result as search
+// seq.
+func (t *tui) run(seq int, q string, from int) {
+	done := searchDone{seq: seq}
+	request, err := queryRequest(strings.Fields(q), *limit, from)
+	if err == nil {
+		request.Highlight = bleve.NewHighlightWithStyle(html.Name)
+		done.result, done.err = t.index.Search(request)
+	} else {
+		done.err = err
+	}
+	t.screen.PostEvent(tcell.NewEventInterrupt(done))
+}
+
+func (t *tui) selectedID() string {
+	if t.result == nil || t.selected >= len(t.result.Hits) {
+		return ""
+	}
+	return t.result.Hits[t.selected].ID
+}
+
+// open hands file to the desktop's default application.
+func (t *tui) open(file string) {
+	opener := "xdg-open"
+	if runtime.GOOS == "darwin" {
+		opener = "open"
+	}
+	cmd := exec.Command(opener, file)
+	if err := cmd.Start(); err != nil {
+		t.message = fmt.Sprintf("Unable to open %q: %v", file, err)
+		return
+	}
+	go cmd.Wait()
+	t.message = fmt.Sprintf("Opened %s", file)
+}
+
+// edit suspends the TUI while $EDITOR runs on file. It only returns an
+// error if the screen can't be set up again.
+func (t *tui) edit(file string) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	t.screen.Fini()
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", file)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stdout
+	err := cmd.Run()
+	if ierr := t.initScreen(); ierr != nil {
+		return fmt.Errorf("Error restoring the screen after %s: %v", editor, ierr)
+	}
+	if err != nil {
+		t.message = fmt.Sprintf("Error running %s: %v", editor, err)
+	}
+	return nil
+}
+
+func (t *tui) previewHeight() int {
+	_, h := t.screen.Size()
+	return h - t.previewStart()
+}
+
+// listRows is the number of screen rows used by the result list. Every hit
+// takes two rows.
+func (t *tui) listRows() int {
+	_, h := t.screen.Size()
+	return (h - 3) / 2 / 2 * 2
+}
+
+func (t *tui) previewStart() int {
+	return 3 + t.listRows()
+}
+
+// put writes s at x, y in style and returns the x after it. Nothing is
+// written past maxX.
+func (t *tui) put(x, y, maxX int, s string, style tcell.Style) int {
+	for _, r := range s {
+		if r == '\n' || r == '\t' || !unicode.IsPrint(r) {
+			r = ' '
+		}
+		w := runewidth.RuneWidth(r)
+		if x+w > maxX {
+			return x
+		}
+		t.screen.SetContent(x, y, r, nil, style)
+		x += w
+	}
+	return x
+}
+
+// putMarked writes a highlighted fragment switching to match while inside
+// mark tags.
+func (t *tui) putMarked(x, y, maxX int, s string, style, match tcell.Style) int {
+	for s != "" {
+		i := strings.Index(s, markStart)
+		if i < 0 {
+			return t.put(x, y, maxX, s, style)
+		}
+		x = t.put(x, y, maxX, s[:i], style)
+		s = s[i+len(markStart):]
+		j := strings.Index(s, markEnd)
+		if j < 0 {
+			j = len(s)
+		}
+		x = t.put(x, y, maxX, s[:j], match)
+		s = strings.TrimPrefix(s[j:], markEnd)
+	}
+	return x
+}
+
+func (t *tui) draw() {
+	t.screen.Clear()
+	w, _ := t.screen.Size()
+	x := t.put(0, 0, w, "Search: ", tuiBold)
+	x = t.put(x, 0, w, string(t.input), tuiNormal)
+	t.screen.ShowCursor(x, 0)
+
+	switch {
+	case t.message != "":
+		t.put(0, 1, w, t.message, tuiStatus)
+	case t.err != nil:
+		t.put(0, 1, w, t.err.Error(), tuiErrorText)
+	case t.result != nil && len(t.result.Hits) == 0:
+		t.put(0, 1, w, fmt.Sprintf("No results in %s. Esc quit", t.result.Took), tuiStatus)
+	case t.result != nil:
+		status := fmt.Sprintf("%d results, %d to %d in %s. Enter open, Ctrl-E edit, Ctrl-N/Ctrl-P page, PgUp/PgDn scroll, Esc quit",
+			t.result.Total, t.from+1, t.from+len(t.result.Hits), t.result.Took)
+		t.put(0, 1, w, status, tuiStatus)
+	}
+	if t.result == nil {
+		t.screen.Show()
+		return
+	}
+
+	hits := t.listRows() / 2
+	if t.selected < t.top {
+		t.top = t.selected
+	} else if t.selected >= t.top+hits {
+		t.top = t.selected - hits + 1
+	}
+	for i := t.top; i < len(t.result.Hits) && i < t.top+hits; i++ {
+		hit := t.result.Hits[i]
+		y := 2 + (i-t.top)*2
+		style := tuiBold
+		if i == t.selected {
+			style = tuiSelected
+			t.put(0, y, w, strings.Repeat(" ", w), style)
+		}
+		x := t.put(0, y, w, fmt.Sprintf("%d. %s", t.from+i+1, hit.ID), style)
+		if hit.Index != "" {
+			t.put(x, y, w, " in "+hit.Index, tuiStatus)
+		}
+		if frags := hit.Fragments["Text"]; len(frags) > 0 {
+			t.putMarked(3, y+1, w, frags[0], tuiNormal, tuiMatch)
+		}
+	}
+	t.drawPreview(w)
+	t.screen.Show()
+}
+
+// drawPreview shows the text of the selected document below the results.
+func (t *tui) drawPreview(w int) {
+	y := t.previewStart() - 1
+	t.put(0, y, w, strings.Repeat("─", w), tuiStatus)
+	id := t.selectedID()
+	if id == "" {
+		return
+	}
+	if id != t.previewID || w != t.previewWidth {
+		t.preview = nil
+		t.previewID, t.previewWidth, t.previewTop = id, w, 0
+		doc, err := t.index.Document(id)
+		if err != nil {
+			t.preview = []string{err.Error()}
+		} else if text, ok := doc["Text"].(string); ok {
+			t.preview = wrapLines(text, w)
+		}
+	}
+	if t.previewTop > len(t.preview)-t.previewHeight() {
+		t.previewTop = len(t.preview) - t.previewHeight()
+	}
+	if t.previewTop < 0 {
+		t.previewTop = 0
+	}
+	words := queryWords(string(t.input))
+	for i := t.previewTop; i < len(t.preview) && y+1 < t.previewStart()+t.previewHeight(); i++ {
+		y++
+		t.putMarked(0, y, w, markWords(t.preview[i], words), tuiNormal, tuiMatch)
+	}
+}
+
+// wrapLines splits text into lines no wider than width. Runes wider than
+// width get a line of their own.
+func wrapLines(text string, width int) []string {
+	if width < 1 {
+		width = 1
+	}
+	lines := []string{}
+	for _, line := range strings.Split(strings.Replace(text, "\t", "    ", -1), "\n") {
+		for runewidth.StringWidth(line) > width && utf8.RuneCountInString(line) > 1 {
+			cut, w := 0, 0
+			for i, r := range line {
+				if w+runewidth.RuneWidth(r) > width {
+					cut = i
+					break
+				}
+				w += runewidth.RuneWidth(r)
+			}
+			if cut == 0 {
+				_, cut = utf8.DecodeRuneInString(line)
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// queryWords returns the plain words of a query string leaving out fields,
+// operators and quotes.
+func queryWords(q string) []string {
+	words := []string{}
+	for _, word := range strings.Fields(q) {
+		if strings.Contains(word, ":") {
+			continue
+		}
+		word = strings.Trim(word, `+-"()*?~^`)
+		if word != "" && word != "AND" && word != "OR" && word != "NOT" {
+			words = append(words, strings.ToLower(word))
+		}
+	}
+	return words
+}
+
+// markWords wraps the words found in line in mark tags.
+func markWords(line string, words []string) string {
+	if len(words) == 0 {
+		return line
+	}
+	lower := strings.ToLower(line)
+	if len(lower) != len(line) {
+		return line
+	}
+	var out strings.Builder
+	for i := 0; i < len(line); {
+		matched := ""
+		for _, word := range words {
+			if strings.HasPrefix(lower[i:], word) && len(word) > len(matched) {
+				matched = word
+			}
+		}
+		if matched == "" {
+			out.WriteByte(line[i])
+			i++
+			continue
+		}
+		out.WriteString(markStart + line[i:i+len(matched)] + markEnd)
+		i += len(matched)
+	}
+	return out.String()
+}
@@ -0,0 +1,31 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWrapLines(t *testing.T) {
+	cases := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"hello world", 5, []string{"hello", " worl", "d"}},
+		{"short\nlines", 10, []string{"short", "lines"}},
+		{"a\tb", 4, []string{"a   ", " b"}},
+		{"日本語", 4, []string{"日本", "語"}},
+		{"日本", 1, []string{"日", "本"}},
+		{"abc", 0, []string{"a", "b", "c"}},
+		{"abc", -3, []string{"a", "b", "c"}},
+		{"", 3, []string{""}},
+	}
+	for _, c := range cases {
+		if got := wrapLines(c.text, c.width); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("wrapLines(%q, %d) = %q, want %q", c.text, c.width, got, c.want)
+		}
+	}
+}
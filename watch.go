@@ -0,0 +1,220 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher keeps the index up to date by routing filesystem events for the
+// watched directories and files through a FileProcessor.
+type Watcher struct {
+	p     FileProcessor
+	fs    *fsnotify.Watcher
+	delay time.Duration
+	// dirs tracks the directories currently being watched.
+	dirs map[string]bool
+	// files are the files watched on their own. Their directories are
+	// watched in fileDirs as editors often replace files rather than
+	// writing to them, but only events for the files themselves are used.
+	files    map[string]bool
+	fileDirs map[string]bool
+	// matchers holds the ignore rules for each directory passed to
+	// IndexDirectory.
+	matchers []*ignoreMatcher
+	// ready receives paths once they have stopped changing until done is
+	// closed when Run returns.
+	ready chan string
+	done  chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// NewWatcher returns a Watcher that waits for delay after the last event on a
+// path before processing it.
+func NewWatcher(p FileProcessor, delay time.Duration) (*Watcher, error) {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		p:        p,
+		fs:       fs,
+		delay:    delay,
+		dirs:     map[string]bool{},
+		files:    map[string]bool{},
+		fileDirs: map[string]bool{},
+		ready:    make(chan string),
+		done:     make(chan struct{}),
+		pending:  map[string]*time.Timer{},
+	}, nil
+}
+
+func (w *Watcher) watchDir(dir string) {
+	if w.dirs[dir] {
+		return
+	}
+	Debugf("Watching directory %q", dir)
+	if err := w.fs.Add(dir); err != nil {
+		log.Printf("Error watching %q, %v\n", dir, err)
+		return
+	}
+	w.dirs[dir] = true
+}
+
+// watchFile watches a single file for changes through its directory.
+func (w *Watcher) watchFile(file string) {
+	w.files[file] = true
+	dir := filepath.Dir(file)
+	if w.dirs[dir] || w.fileDirs[dir] {
+		return
+	}
+	Debugf("Watching file %q", file)
+	if err := w.fs.Add(dir); err != nil {
+		log.Printf("Error watching %q, %v\n", file, err)
+		return
+	}
+	w.fileDirs[dir] = true
+}
+
+// watched returns true if events for path are of interest, which is
+// everything in watched directories but only the watched files of
+// directories watched for their sake.
+func (w *Watcher) watched(path string) bool {
+	dir := filepath.Dir(path)
+	return !w.fileDirs[dir] || w.dirs[dir] || w.dirs[path] || w.files[path]
+}
+
+// matcherFor returns the ignoreMatcher for the watched tree containing path.
+func (w *Watcher) matcherFor(path string) *ignoreMatcher {
+	for _, m := range w.matchers {
+		if m.Contains(path) {
+			return m
+		}
+	}
+	m := newIgnoreMatcherFor(path)
+	w.matchers = append(w.matchers, m)
+	return m
+}
+
+// IndexDirectory indexes all the files in a directory recursively and
+// watches every directory visited for changes.
+func (w *Watcher) IndexDirectory(dir string) {
+	log.Printf("Processing directory: %q", dir)
+	pool := newIndexPool(w.p, *workers)
+	walkDirectory(dir, w.matcherFor(dir), w.watchDir, pool.Add)
+	pool.Wait()
+}
+
+// IndexFile indexes a single file and watches it for changes.
+func (w *Watcher) IndexFile(file string) {
+	IndexFile(file, w.p)
+	w.watchFile(file)
+}
+
+// schedule queues path for processing once no new events have arrived for it
+// within the Watcher's delay.
+func (w *Watcher) schedule(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t, ok := w.pending[path]; ok {
+		t.Reset(w.delay)
+		return
+	}
+	w.pending[path] = time.AfterFunc(w.delay, func() {
+		w.mu.Lock()
+		delete(w.pending, path)
+		w.mu.Unlock()
+		select {
+		case w.ready <- path:
+		case <-w.done:
+		}
+	})
+}
+
+// ignored returns true for paths the directory walk would also skip.
+func ignored(path string) bool {
+	return (strings.HasPrefix(filepath.Base(path), ".") && !isMaildirFolder(path)) ||
+		underRoots(path, []string{absPath(*indexLocation), absPath(*hashLocation)})
+}
+
+// sync brings the index in line with the current state of path.
+func (w *Watcher) sync(path string) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if w.dirs[path] {
+			// The watch is dropped by inotify along with the directory.
+			for dir := range w.dirs {
+				if underRoots(dir, []string{path}) {
+					delete(w.dirs, dir)
+				}
+			}
+			PruneIndex([]string{path}, w.p)
+			return
+		}
+		if err := w.p.Remove(path); err != nil {
+			log.Printf("Error removing file %q, %v\n", path, err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error Stat(ing) file %q", err)
+		return
+	}
+	if !w.files[path] && w.matcherFor(path).Ignored(path, fi.IsDir()) {
+		return
+	}
+	if fi.IsDir() {
+		if !w.dirs[path] && !skipDirectory(path) {
+			w.IndexDirectory(path)
+		}
+		return
+	}
+	IndexFile(path, w.p)
+}
+
+// Run processes filesystem events until the process is interrupted.
+func (w *Watcher) Run() error {
+	defer w.fs.Close()
+	defer close(w.done)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	log.Printf("Watching %d directories and %d files for changes", len(w.dirs), len(w.files))
+	for {
+		select {
+		case ev := <-w.fs.Events:
+			if name := filepath.Base(ev.Name); name == ignoreFileName || name == ".gitignore" {
+				w.matcherFor(ev.Name).Forget(filepath.Dir(ev.Name))
+			}
+			name := filepath.Clean(ev.Name)
+			if ev.Op == fsnotify.Chmod || !w.watched(name) || (!w.files[name] && ignored(name)) {
+				continue
+			}
+			Debugf("Filesystem event: %s", ev)
+			w.schedule(name)
+		case path := <-w.ready:
+			w.sync(path)
+			if err := w.p.Flush(); err != nil {
+				log.Print(err)
+			}
+		case err := <-w.fs.Errors:
+			log.Printf("Error watching files, %v\n", err)
+		case sig := <-sigs:
+			log.Printf("Received %s, stopping watch", sig)
+			return nil
+		}
+	}
+}
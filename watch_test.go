@@ -0,0 +1,36 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	defer func(index, hash string) { *indexLocation, *hashLocation = index, hash }(*indexLocation, *hashLocation)
+	*indexLocation, *hashLocation = "data/index.bleve", "/var/goin/hashes"
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(cwd, "data/index.bleve"), true},
+		{filepath.Join(cwd, "data/index.bleve/store/000001.zap"), true},
+		{filepath.Join(cwd, "data/index.bleve2/doc.txt"), false},
+		{filepath.Join(cwd, "data/doc.txt"), false},
+		{"/var/goin/hashes/abc", true},
+		{"/var/goin/hashes2", false},
+		{filepath.Join(cwd, "data/.hidden"), true},
+	}
+	for _, c := range cases {
+		if got := ignored(c.path); got != c.want {
+			t.Errorf("ignored(%q) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
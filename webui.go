@@ -0,0 +1,275 @@
+// Copyright 2015 Jeremy Wall (jeremy@marzhillstudios.com)
+// Use of this source code is governed by the Artistic License 2.0.
+// That License is included in the LICENSE file.
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// serveSearchPage serves the web search UI. It talks to the same /api
+// endpoints as any other client.
+func serveSearchPage(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(rw, searchPage)
+}
+
+// searchPage is a self contained search page. The fragments bleve returns
+// aren't escaped so everything but the <mark> tags of the html highlighter
+// is escaped before it is shown.
+const searchPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>goin</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+header { padding: 1em 2em; background: #f4f4f4; border-bottom: 1px solid #ddd; }
+header form { display: flex; flex-wrap: wrap; gap: .5em; align-items: center; }
+#q { flex: 1; min-width: 20em; font-size: 1.1em; padding: .3em; }
+main { display: flex; gap: 2em; padding: 1em 2em; }
+#facets { width: 16em; flex-shrink: 0; font-size: .9em; }
+#facets h3 { font-size: 1em; margin: 1em 0 .3em; }
+#facets a { display: block; color: #225; text-decoration: none; }
+#facets a.active { font-weight: bold; }
+#results { flex: 1; min-width: 0; }
+.hit { margin-bottom: 1.2em; }
+.hit .path { font-weight: bold; word-break: break-all; }
+.hit .meta { color: #666; font-size: .85em; }
+.hit .frag { margin: .3em 0; white-space: pre-wrap; }
+mark { background: #ffe46b; }
+#status { color: #666; margin-bottom: 1em; }
+#pager button { margin-right: .5em; }
+#preview { display: none; position: fixed; top: 5%; left: 10%; right: 10%; bottom: 5%; background: #fff;
+  border: 1px solid #888; box-shadow: 0 0 2em #888; padding: 1em; overflow: auto; }
+#preview pre { white-space: pre-wrap; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<header>
+<form id="search">
+  <select id="index" title="Index"></select>
+  <input id="q" type="search" placeholder="Search" autofocus>
+  <select id="type" title="Type">
+    <option value="">Any type</option>
+    <option value="text/">Text</option>
+    <option value="application/pdf">PDF</option>
+    <option value="image/">Images</option>
+    <option value="audio/">Audio</option>
+    <option value="message/rfc822">Email</option>
+    <option value="application/vnd.">Office</option>
+  </select>
+  <label>Modified from <input id="since" type="date"></label>
+  <label>to <input id="until" type="date"></label>
+  <button type="submit">Search</button>
+</form>
+</header>
+<main>
+<div id="facets"></div>
+<div id="results">
+  <div id="status"></div>
+  <div id="hits"></div>
+  <div id="pager">
+    <button id="prev" type="button">Previous</button>
+    <button id="next" type="button">Next</button>
+  </div>
+</div>
+</main>
+<div id="preview">
+  <button id="close" type="button">Close</button>
+  <h2 id="preview-title"></h2>
+  <div id="preview-fields"></div>
+  <pre id="preview-text"></pre>
+</div>
+<script>
+"use strict";
+var pageSize = 10;
+var state = { from: 0, drills: [] };
+var facetFields = ["MimeType", "Author", "Artist", "Genre"];
+
+function $(id) { return document.getElementById(id); }
+
+function escapeHTML(s) {
+  return String(s).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+}
+
+// highlighted escapes a fragment keeping the <mark> tags around matches.
+function highlighted(frag) {
+  return escapeHTML(frag).replace(/&lt;mark&gt;/g, "<mark>").replace(/&lt;\/mark&gt;/g, "</mark>");
+}
+
+function api(method, path, body) {
+  var opts = { method: method, headers: {} };
+  if (body) {
+    opts.body = JSON.stringify(body);
+    opts.headers["Content-Type"] = "application/json";
+  }
+  return fetch(path, opts).then(function(resp) {
+    return resp.text().then(function(text) {
+      var data = null;
+      try { data = JSON.parse(text); } catch (e) {}
+      if (!resp.ok || data === null) { throw new Error((data && data.error) || text || resp.statusText); }
+      return data;
+    });
+  });
+}
+
+function indexPath(rest) {
+  return "/api/" + encodeURIComponent($("index").value) + rest;
+}
+
+function fileURL(id) {
+  return "/files/" + encodeURIComponent(id);
+}
+
+function buildQuery() {
+  var q = $("q").value.trim();
+  var conjuncts = [q ? { query: q } : { match_all: {} }];
+  var type = $("type").value;
+  if (type) {
+    if (type.slice(-1) === "/" || type.slice(-1) === ".") {
+      conjuncts.push({ prefix: type, field: "MimeType" });
+    } else {
+      conjuncts.push({ term: type, field: "MimeType" });
+    }
+  }
+  var since = $("since").value, until = $("until").value;
+  if (since || until) {
+    var dr = { field: "ModTime" };
+    if (since) { dr.start = new Date(since + "T00:00:00").toISOString(); }
+    if (until) {
+      var end = new Date(until + "T00:00:00");
+      end.setDate(end.getDate() + 1);
+      dr.end = end.toISOString();
+    }
+    conjuncts.push(dr);
+  }
+  state.drills.forEach(function(d) { conjuncts.push({ term: d.term, field: d.field }); });
+  return { conjuncts: conjuncts };
+}
+
+function search() {
+  var facets = {};
+  facetFields.forEach(function(f) { facets[f] = { field: f, size: 10 }; });
+  var req = {
+    query: buildQuery(),
+    size: pageSize,
+    from: state.from,
+    highlight: { style: "html", fields: ["Text"] },
+    fields: ["FileName", "MimeType", "ModTime", "Size"],
+    facets: facets
+  };
+  $("status").textContent = "Searching...";
+  api("POST", indexPath("/_search"), req).then(render, function(err) {
+    $("status").innerHTML = '<span class="error">' + escapeHTML(err.message) + "</span>";
+    $("hits").innerHTML = "";
+    $("facets").innerHTML = "";
+  });
+}
+
+function formatSize(n) {
+  var units = ["B", "k", "M", "G", "T"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return (i ? n.toFixed(1) : n) + units[i];
+}
+
+function render(result) {
+  var total = result.total_hits;
+  var last = state.from + result.hits.length;
+  $("status").textContent = total ? (total + " results, " + (state.from + 1) + " to " + last) : "No results";
+  $("prev").disabled = state.from === 0;
+  $("next").disabled = last >= total;
+  $("hits").innerHTML = result.hits.map(function(hit) {
+    var f = hit.fields || {};
+    var meta = [f.MimeType, f.Size !== undefined ? formatSize(f.Size) : "", f.ModTime ? new Date(f.ModTime).toLocaleString() : ""];
+    var frags = (hit.fragments && hit.fragments.Text) || [];
+    return '<div class="hit">' +
+      '<div class="path">' + escapeHTML(hit.id) + "</div>" +
+      '<div class="meta">' + meta.filter(Boolean).map(escapeHTML).join(" · ") +
+      ' · <a href="#" data-id="' + escapeHTML(hit.id) + '" class="show">Preview</a>' +
+      ' · <a href="' + escapeHTML(fileURL(hit.id)) + '" target="_blank" rel="noopener">Open</a>' +
+      ' · <a href="' + escapeHTML(fileURL(hit.id) + "?download=1") + '">Download</a></div>' +
+      frags.map(function(fr) { return '<div class="frag">' + highlighted(fr) + "</div>"; }).join("") +
+      "</div>";
+  }).join("");
+  renderFacets(result.facets || {});
+}
+
+function renderFacets(facets) {
+  var html = "";
+  state.drills.forEach(function(d, i) {
+    html += '<a href="#" class="active" data-undrill="' + i + '">✕ ' + escapeHTML(d.field + ": " + d.term) + "</a>";
+  });
+  facetFields.forEach(function(name) {
+    var f = facets[name];
+    if (!f || !f.terms || !f.terms.length) { return; }
+    html += "<h3>" + escapeHTML(name) + "</h3>";
+    f.terms.forEach(function(t) {
+      html += '<a href="#" data-field="' + escapeHTML(name) + '" data-term="' + escapeHTML(t.term) + '">' +
+        escapeHTML(t.term) + " (" + t.count + ")</a>";
+    });
+  });
+  $("facets").innerHTML = html;
+}
+
+function showPreview(id) {
+  $("preview-title").textContent = id;
+  $("preview-fields").textContent = "";
+  $("preview-text").textContent = "Loading...";
+  $("preview").style.display = "block";
+  api("GET", indexPath("/doc/" + encodeURIComponent(id))).then(function(doc) {
+    var fields = doc.fields || {};
+    $("preview-fields").innerHTML = Object.keys(fields).sort().filter(function(k) { return k !== "Text"; }).map(function(k) {
+      return "<div><b>" + escapeHTML(k) + ":</b> " + escapeHTML(fields[k]) + "</div>";
+    }).join("");
+    $("preview-text").textContent = fields.Text || "";
+  }, function(err) {
+    $("preview-text").textContent = err.message;
+  });
+}
+
+$("search").addEventListener("submit", function(e) {
+  e.preventDefault();
+  state.from = 0;
+  search();
+});
+["index", "type", "since", "until"].forEach(function(id) {
+  $(id).addEventListener("change", function() { state.from = 0; state.drills = []; search(); });
+});
+$("prev").addEventListener("click", function() { state.from = Math.max(0, state.from - pageSize); search(); });
+$("next").addEventListener("click", function() { state.from += pageSize; search(); });
+$("close").addEventListener("click", function() { $("preview").style.display = "none"; });
+$("hits").addEventListener("click", function(e) {
+  if (e.target.classList.contains("show")) {
+    e.preventDefault();
+    showPreview(e.target.getAttribute("data-id"));
+  }
+});
+$("facets").addEventListener("click", function(e) {
+  var a = e.target;
+  if (a.tagName !== "A") { return; }
+  e.preventDefault();
+  if (a.hasAttribute("data-undrill")) {
+    state.drills.splice(Number(a.getAttribute("data-undrill")), 1);
+  } else {
+    state.drills.push({ field: a.getAttribute("data-field"), term: a.getAttribute("data-term") });
+  }
+  state.from = 0;
+  search();
+});
+
+api("GET", "/api").then(function(data) {
+  $("index").innerHTML = data.indexes.sort().map(function(name) {
+    return "<option>" + escapeHTML(name) + "</option>";
+  }).join("");
+  search();
+}, function(err) {
+  $("status").innerHTML = '<span class="error">' + escapeHTML(err.message) + "</span>";
+});
+</script>
+</body>
+</html>
+`